@@ -147,7 +147,7 @@ func (t *BL) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byt
 		return []byte("Error: Required field not provided."), nil
 	} else if bl.EXPORT_REFERENCES == "" {
 		return []byte("Error: Required field not provided."), nil
-	} else if bl.LC_NUMBER == "" {
+	} else if bl.LC_NUMBER == "" && len(lcJSON) != 0 {
 		return []byte("Error: Required field not provided."), nil
 	} else if bl.NUMBER_AND_SEQUENCE_OF_ORIGINAL_BLS == "" {
 		return []byte("Error: Required field not provided."), nil
@@ -181,6 +181,12 @@ func (t *BL) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byt
 		return []byte("Error: Required field not provided."), nil
 	}
 
+	// Documents presented under a collection have no LC to be checked against
+	if len(lcJSON) == 0 {
+		resultMap["result"] = "Success: All validation checks passed"
+		return json.Marshal(resultMap)
+	}
+
 	var lc LC
 	err = json.Unmarshal(lcJSON, &lc)
 	if err != nil {
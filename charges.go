@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CHARGES holds the bank charges recorded against a contract: CHARGES + UID
+const CHARGES = "CHARGES~"
+
+// Charge types
+const (
+	CHARGE_ISSUANCE     = "ISSUANCE"
+	CHARGE_ADVISING     = "ADVISING"
+	CHARGE_CONFIRMATION = "CONFIRMATION"
+	CHARGE_AMENDMENT    = "AMENDMENT"
+	CHARGE_DISCREPANCY  = "DISCREPANCY"
+)
+
+// Parties charges are allocated to
+const (
+	FOR_APPLICANT   = "APPLICANT"
+	FOR_BENEFICIARY = "BENEFICIARY"
+)
+
+var chargeTypes = toSet([]string{CHARGE_ISSUANCE, CHARGE_ADVISING, CHARGE_CONFIRMATION, CHARGE_AMENDMENT, CHARGE_DISCREPANCY})
+
+// chargingBanks are the roles that may charge a fee against an LC
+var chargingBanks = toSet([]string{"ImporterBank", "ExporterBank", "ReimbursingBank"})
+
+// Charge is one fee a bank has recorded against a contract
+type Charge struct {
+	ChargeNo   int
+	Type       string
+	Bank       string // ImporterBank (the issuing bank), ExporterBank or ReimbursingBank
+	Currency   string
+	Amount     float64
+	ChargedTo  string
+	Reference  string `json:",omitempty"`
+	RecordedOn string
+	TxID       string
+	Deducted   bool // taken out of the beneficiary's proceeds
+}
+
+// ChargeAllocation is how Tag71B splits charges between applicant and beneficiary
+type ChargeAllocation struct {
+	IssuingBank string // charges of the issuing bank
+	OtherBanks  string // charges of every other bank
+}
+
+// Charges lists the charges of a contract with what each party owes
+type Charges struct {
+	ContractID  string
+	Tag71B      string
+	Allocation  ChargeAllocation
+	Charges     []Charge
+	Applicant   map[string]float64
+	Beneficiary map[string]float64
+}
+
+// chargeFillerWords may stand between "FOR" or "BY" and the party charges are for,
+// e.g. "FOR THE ACCOUNT OF THE BENEFICIARY"
+var chargeFillerWords = toSet([]string{"THE", "ACCOUNT", "OF", "A", "AN"})
+
+// chargedParty returns the party of the first "FOR (THE ACCOUNT OF) <party>" or "(BORNE) BY <party>" phrase
+// in the wording of Tag71B, or "" if there is none. Parties named elsewhere, as in "OUTSIDE APPLICANT'S
+// COUNTRY", only describe which charges are meant.
+func chargedParty(wording string) string {
+	words := strings.FieldsFunc(strings.ToUpper(wording), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+	for i, word := range words {
+		if word != "FOR" && word != "BY" {
+			continue
+		}
+		j := i + 1
+		for j < len(words) && chargeFillerWords[words[j]] {
+			j++
+		}
+		if j == len(words) {
+			break
+		}
+		if strings.HasPrefix(words[j], "BENEFICIAR") {
+			return FOR_BENEFICIARY
+		}
+		if strings.HasPrefix(words[j], "APPLICANT") {
+			return FOR_APPLICANT
+		}
+	}
+	return ""
+}
+
+// allocateCharges reads the wording of Tag71B. Without instructions the applicant pays all charges, as the
+// party instructing the banks (UCP 600 article 37). Wording that puts charges for the account of a party
+// puts them on it, and "OUTSIDE" limits that to the charges of banks other than the issuing bank, e.g.
+// "ALL BANKING CHARGES OUTSIDE APPLICANT'S COUNTRY ARE FOR ACCOUNT OF BENEFICIARY".
+func allocateCharges(tag71B string) ChargeAllocation {
+	allocation := ChargeAllocation{IssuingBank: FOR_APPLICANT, OtherBanks: FOR_APPLICANT}
+
+	party := chargedParty(tag71B)
+	if party == "" {
+		return allocation
+	}
+
+	allocation.OtherBanks = party
+	if !strings.Contains(strings.ToUpper(tag71B), "OUTSIDE") {
+		allocation.IssuingBank = party
+	}
+	return allocation
+}
+
+// chargedTo allocates a charge. Discrepancy fees are always for the beneficiary whose presentation was discrepant.
+func (a ChargeAllocation) chargedTo(chargeType string, bank string) string {
+	if chargeType == CHARGE_DISCREPANCY {
+		return FOR_BENEFICIARY
+	}
+	if bank == "ImporterBank" {
+		return a.IssuingBank
+	}
+	return a.OtherBanks
+}
+
+func getCharges(stub shim.ChaincodeStubInterface, UID string) ([]Charge, error) {
+	charges := make([]Charge, 0)
+	recBytes, err := stub.GetState(CHARGES + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + CHARGES + UID)
+	}
+	if recBytes != nil {
+		err = json.Unmarshal(recBytes, &charges)
+		if err != nil {
+			return nil, errors.New("Failed to unmarshal charges of " + UID)
+		}
+	}
+	return charges, nil
+}
+
+func putCharges(stub shim.ChaincodeStubInterface, UID string, charges []Charge) error {
+	recBytes, _ := json.Marshal(charges)
+	return stub.PutState(CHARGES+UID, recBytes)
+}
+
+// lcChargeAllocation reads Tag71B of the LC of a contract
+func (t *TF) lcChargeAllocation(stub shim.ChaincodeStubInterface, UID string) (string, ChargeAllocation, error) {
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return "", ChargeAllocation{}, err
+	}
+	if len(lcJSON) == 0 {
+		return "", ChargeAllocation{}, errors.New("No LC exists for " + UID)
+	}
+	var lc LC
+	err = json.Unmarshal(lcJSON, &lc)
+	if err != nil {
+		return "", ChargeAllocation{}, err
+	}
+	return lc.Tag71B, allocateCharges(lc.Tag71B), nil
+}
+
+// addCharge allocates a charge per Tag71B and records it against the contract
+func (t *TF) addCharge(stub shim.ChaincodeStubInterface, UID string, chargeType string, bank string, currency string, amount float64, reference string) error {
+	_, allocation, err := t.lcChargeAllocation(stub, UID)
+	if err != nil {
+		return err
+	}
+	charges, err := getCharges(stub, UID)
+	if err != nil {
+		return err
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+
+	charge := Charge{
+		ChargeNo:   len(charges) + 1,
+		Type:       chargeType,
+		Bank:       bank,
+		Currency:   currency,
+		Amount:     amount,
+		ChargedTo:  allocation.chargedTo(chargeType, bank),
+		Reference:  reference,
+		RecordedOn: now.Format(time_format),
+		TxID:       stub.GetTxID(),
+	}
+	return putCharges(stub, UID, append(charges, charge))
+}
+
+// callerChargingBank returns the bank role the caller holds on a contract, or "" if it holds none
+func (t *TF) callerChargingBank(stub shim.ChaincodeStubInterface, UID string) (string, error) {
+	res, err := t.isCallerImporterBank(stub, []string{UID})
+	if err != nil {
+		return "", err
+	}
+	if res {
+		return "ImporterBank", nil
+	}
+	res, err = t.isCallerExporterBank(stub, []string{UID})
+	if err != nil {
+		return "", err
+	}
+	if res {
+		return "ExporterBank", nil
+	}
+	// not every LC has a reimbursing bank
+	res, err = t.isCallerReimbursingBank(stub, []string{UID})
+	if err == nil && res {
+		return "ReimbursingBank", nil
+	}
+	return "", nil
+}
+
+// recordCharge records a bank's fee against a contract; args: UID, type, bank role, amount as currency and amount e.g. "USD50,00", reference.
+// With access control on, the bank role is the one the caller holds on the contract and the bank role argument is ignored.
+func (t *TF) recordCharge(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5.")
+	}
+
+	bank := args[2]
+	if accessControlFlag == true {
+		var err error
+		bank, err = t.callerChargingBank(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		if bank == "" {
+			return nil, errors.New("Access denied.")
+		}
+	}
+	chargeType := strings.ToUpper(args[1])
+	if !chargeTypes[chargeType] {
+		return nil, errors.New("Charge type should be ISSUANCE, ADVISING, CONFIRMATION, AMENDMENT or DISCREPANCY")
+	}
+	if !chargingBanks[bank] {
+		return nil, errors.New("Bank should be ImporterBank, ExporterBank or ReimbursingBank")
+	}
+	currency, amount, err := parseTag32B(args[3])
+	if err != nil {
+		return nil, err
+	}
+	if amount <= 0 {
+		return nil, errors.New("Charge amount should be a positive number")
+	}
+	if !isoCurrencyCodes[currency] {
+		return nil, errors.New("Charge currency " + currency + " is not an ISO 4217 currency code")
+	}
+	return nil, t.addCharge(stub, args[0], chargeType, bank, currency, amount, args[4])
+}
+
+// deductBeneficiaryCharges takes the beneficiary's outstanding charges in the currency of the proceeds
+// out of them and marks those charges as deducted
+func deductBeneficiaryCharges(stub shim.ChaincodeStubInterface, UID string, currency string, proceeds float64) (float64, error) {
+	charges, err := getCharges(stub, UID)
+	if err != nil {
+		return 0, err
+	}
+	deducted := 0.0
+	for i := range charges {
+		charge := &charges[i]
+		if charge.ChargedTo != FOR_BENEFICIARY || charge.Deducted || charge.Currency != currency {
+			continue
+		}
+		if deducted+charge.Amount > proceeds {
+			break
+		}
+		deducted += charge.Amount
+		charge.Deducted = true
+	}
+	if deducted == 0 {
+		return 0, nil
+	}
+	return math.Floor(deducted*100+0.5) / 100, putCharges(stub, UID, charges)
+}
+
+// getCharges returns the charges of a contract and the totals owed by applicant and beneficiary per currency; args: UID
+func (t *TF) getCharges(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	tag71B, allocation, err := t.lcChargeAllocation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	charges, err := getCharges(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	result := Charges{ContractID: args[0], Tag71B: tag71B, Allocation: allocation, Charges: charges, Applicant: map[string]float64{}, Beneficiary: map[string]float64{}}
+	for _, charge := range charges {
+		if charge.ChargedTo == FOR_BENEFICIARY {
+			result.Beneficiary[charge.Currency] += charge.Amount
+		} else {
+			result.Applicant[charge.Currency] += charge.Amount
+		}
+	}
+	return json.Marshal(result)
+}
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestAllocateCharges(t *testing.T) {
+	cases := []struct {
+		tag71B string
+		want   ChargeAllocation
+	}{
+		{"", ChargeAllocation{FOR_APPLICANT, FOR_APPLICANT}},
+		{"ALL CHARGES FOR APPLICANT", ChargeAllocation{FOR_APPLICANT, FOR_APPLICANT}},
+		{"All banking charges are for account of the beneficiary", ChargeAllocation{FOR_BENEFICIARY, FOR_BENEFICIARY}},
+		{"ALL CHARGES OUTSIDE ISSUING BANK FOR BENEFICIARY", ChargeAllocation{FOR_APPLICANT, FOR_BENEFICIARY}},
+		{"ALL BANKING CHARGES OUTSIDE APPLICANT'S COUNTRY ARE FOR ACCOUNT OF BENEFICIARY", ChargeAllocation{FOR_APPLICANT, FOR_BENEFICIARY}},
+		{"ALL CHARGES ARE FOR THE ACCOUNT OF THE BENEFICIARY", ChargeAllocation{FOR_BENEFICIARY, FOR_BENEFICIARY}},
+		{"CHARGES OUTSIDE BENEFICIARY'S COUNTRY BORNE BY APPLICANT", ChargeAllocation{FOR_APPLICANT, FOR_APPLICANT}},
+	}
+	for _, c := range cases {
+		if got := allocateCharges(c.tag71B); got != c.want {
+			t.Errorf("allocateCharges(%q) = %+v, want %+v", c.tag71B, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,409 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// DC_PREFIX prefixes the world state record of a documentary collection: DC_PREFIX + UID
+const DC_PREFIX = "DC_"
+
+// Collection terms under URC 522
+const (
+	DOCUMENTS_AGAINST_PAYMENT    = "D/P"
+	DOCUMENTS_AGAINST_ACCEPTANCE = "D/A"
+)
+
+// Collection lifecycle states
+const (
+	DC_INSTRUCTED         = "INSTRUCTED"
+	DC_DOCUMENTS_SENT     = "DOCUMENTS_SENT"
+	DC_PRESENTED          = "PRESENTED_TO_DRAWEE"
+	DC_DRAFT_ACCEPTED     = "DRAFT_ACCEPTED"
+	DC_PAID               = "PAID"
+	DC_PROCEEDS_REMITTED  = "PROCEEDS_REMITTED"
+	DC_DISHONOURED        = "DISHONOURED"
+	DC_DOCUMENTS_RETURNED = "DOCUMENTS_RETURNED"
+)
+
+// DC implements the documentary collection smart contract. The struct is the collection instruction
+// the remitting bank sends with the documents.
+type DC struct {
+	CollectionNumber    string
+	Terms               string // D/P or D/A
+	Drawer              string // Exporter
+	Drawee              string // Importer
+	RemittingBank       string // Exporter's bank
+	CollectingBank      string // Importer's bank
+	Currency            string
+	Amount              string
+	TenorDays           int // D/A only: days after acceptance the draft matures
+	DateOfIssue         string
+	ProtestInstructions string
+	Charges             string
+}
+
+// DCEvent records one step of a collection
+type DCEvent struct {
+	Status  string
+	Role    string
+	Comment string `json:"Comment,omitempty"`
+	TxID    string
+	Date    string
+}
+
+// DCRecord is the on-ledger state of a collection
+type DCRecord struct {
+	ContractID        string
+	Instruction       DC
+	Status            string
+	DocumentsReleased bool
+	MaturityDate      string `json:"MaturityDate,omitempty"`
+	History           []DCEvent
+}
+
+// dcTransition is one allowed step of the collection state machine
+type dcTransition struct {
+	From  string
+	To    string
+	Role  string
+	Terms string // empty if the step applies to both D/P and D/A
+}
+
+var dcTransitions = []dcTransition{
+	{DC_INSTRUCTED, DC_DOCUMENTS_SENT, "RemittingBank", ""},
+	{DC_DOCUMENTS_SENT, DC_PRESENTED, "CollectingBank", ""},
+	// D/P: documents are released when the drawee pays
+	{DC_PRESENTED, DC_PAID, "CollectingBank", DOCUMENTS_AGAINST_PAYMENT},
+	// D/A: documents are released when the drawee accepts the draft, which is paid at maturity
+	{DC_PRESENTED, DC_DRAFT_ACCEPTED, "Drawee", DOCUMENTS_AGAINST_ACCEPTANCE},
+	{DC_DRAFT_ACCEPTED, DC_PAID, "CollectingBank", DOCUMENTS_AGAINST_ACCEPTANCE},
+	{DC_PAID, DC_PROCEEDS_REMITTED, "CollectingBank", ""},
+	{DC_PRESENTED, DC_DISHONOURED, "CollectingBank", ""},
+	{DC_DRAFT_ACCEPTED, DC_DISHONOURED, "CollectingBank", DOCUMENTS_AGAINST_ACCEPTANCE},
+	// Only documents not yet released to the drawee can be returned
+	{DC_DISHONOURED, DC_DOCUMENTS_RETURNED, "CollectingBank", ""},
+}
+
+func dcKey(UID string) string {
+	return DC_PREFIX + UID
+}
+
+// ValidateDoc () – checks a collection instruction; args: instructionJSON
+func (t *DC) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	var dc DC
+	err := json.Unmarshal([]byte(args[0]), &dc)
+	if err != nil {
+		return nil, errors.New("Collection instruction should be a JSON object " + err.Error())
+	}
+
+	var problems []string
+	if dc.CollectionNumber == "" {
+		problems = append(problems, "CollectionNumber: required field not provided")
+	}
+	if dc.Drawer == "" {
+		problems = append(problems, "Drawer: required field not provided")
+	}
+	if dc.Drawee == "" {
+		problems = append(problems, "Drawee: required field not provided")
+	}
+	if dc.RemittingBank == "" {
+		problems = append(problems, "RemittingBank: required field not provided")
+	}
+	if dc.CollectingBank == "" {
+		problems = append(problems, "CollectingBank: required field not provided")
+	}
+	if dc.Terms != DOCUMENTS_AGAINST_PAYMENT && dc.Terms != DOCUMENTS_AGAINST_ACCEPTANCE {
+		problems = append(problems, "Terms: should be D/P or D/A")
+	}
+	if dc.Terms == DOCUMENTS_AGAINST_ACCEPTANCE && dc.TenorDays <= 0 {
+		problems = append(problems, "TenorDays: a D/A collection needs the tenor of the draft")
+	}
+	if !isoCurrencyCodes[dc.Currency] {
+		problems = append(problems, "Currency: "+dc.Currency+" is not an ISO 4217 currency code")
+	}
+	if amount, err := parseDecimal(dc.Amount); err != nil || amount <= 0 {
+		problems = append(problems, "Amount: should be a positive number")
+	}
+	if _, err := time.Parse(time_format, dc.DateOfIssue); err != nil {
+		problems = append(problems, "DateOfIssue: incorrect date format. Expecting mm/dd/yyyy")
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("Validation failure: " + strings.Join(problems, "; "))
+	}
+	return []byte("SUCCESS"), nil
+}
+
+// getDCRecord reads a collection; nil if none exists
+func getDCRecord(stub shim.ChaincodeStubInterface, UID string) (*DCRecord, error) {
+	recBytes, err := stub.GetState(dcKey(UID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get collection %s. Error %s", UID, err.Error())
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var record DCRecord
+	err = json.Unmarshal(recBytes, &record)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal collection %s", UID)
+	}
+	return &record, nil
+}
+
+func putDCRecord(stub shim.ChaincodeStubInterface, record *DCRecord) error {
+	recBytes, _ := json.Marshal(record)
+	return stub.PutState(dcKey(record.ContractID), recBytes)
+}
+
+// txDate returns the time of the transaction, the same on every peer
+func txDate(stub shim.ChaincodeStubInterface) (time.Time, error) {
+	ts, err := stub.GetTxTimestamp()
+	if err != nil || ts == nil {
+		return time.Time{}, errors.New("Failed to get the transaction timestamp")
+	}
+	return time.Unix(ts.Seconds, int64(ts.Nanos)).UTC(), nil
+}
+
+// SubmitDoc () – records a collection instruction from the remitting bank; args: UID, instructionJSON
+func (t *DC) SubmitDoc(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+
+	UID := args[0]
+	_, err := t.ValidateDoc(stub, []string{args[1]})
+	if err != nil {
+		return nil, err
+	}
+
+	existing, err := getDCRecord(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("Document already exists.")
+	}
+
+	var record DCRecord
+	record.ContractID = UID
+	json.Unmarshal([]byte(args[1]), &record.Instruction)
+	record.Status = DC_INSTRUCTED
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	record.History = append(record.History, DCEvent{Status: DC_INSTRUCTED, Role: "RemittingBank", TxID: stub.GetTxID(), Date: now.Format(time_format)})
+
+	return nil, putDCRecord(stub, &record)
+}
+
+// allowedDCTransitions lists the steps that can be taken from the collection's current state
+func allowedDCTransitions(record *DCRecord) []dcTransition {
+	var allowed []dcTransition
+	for _, transition := range dcTransitions {
+		if transition.From == record.Status && (transition.Terms == "" || transition.Terms == record.Instruction.Terms) {
+			allowed = append(allowed, transition)
+		}
+	}
+	return allowed
+}
+
+// UpdateStatus () – moves a collection to its next state; args: UID, status, role, comment.
+// Documents are only sent with sendCollectionDocuments, which checks and stores them.
+func (t *DC) UpdateStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+	if args[1] == DC_DOCUMENTS_SENT {
+		return nil, errors.New("Collection documents are sent with sendCollectionDocuments")
+	}
+	return t.updateStatus(stub, args)
+}
+
+func (t *DC) updateStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+
+	UID := args[0]
+	status := args[1]
+	who := args[2]
+
+	record, err := getDCRecord(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("No collection exists for " + UID)
+	}
+
+	var step *dcTransition
+	for _, transition := range allowedDCTransitions(record) {
+		if transition.To == status {
+			transition := transition
+			step = &transition
+			break
+		}
+	}
+	if step == nil {
+		return nil, errors.New("Collection " + UID + " (" + record.Instruction.Terms + ") cannot move from " + record.Status + " to " + status)
+	}
+	if step.Role != who {
+		return nil, errors.New("Only the " + step.Role + " can move collection " + UID + " to " + status)
+	}
+	if status == DC_DOCUMENTS_RETURNED && record.DocumentsReleased {
+		return nil, errors.New("Documents of collection " + UID + " were released to the drawee and cannot be returned")
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if status == DC_DRAFT_ACCEPTED {
+		record.DocumentsReleased = true
+		record.MaturityDate = now.AddDate(0, 0, record.Instruction.TenorDays).Format(time_format)
+	} else if status == DC_PAID && record.Instruction.Terms == DOCUMENTS_AGAINST_PAYMENT {
+		record.DocumentsReleased = true
+	}
+	record.Status = status
+	record.History = append(record.History, DCEvent{Status: status, Role: who, Comment: args[3], TxID: stub.GetTxID(), Date: now.Format(time_format)})
+
+	return nil, putDCRecord(stub, record)
+}
+
+// GetJSON () – returns the collection with its history
+func (t *DC) GetJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := getDCRecord(stub, args[0])
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// GetStatus () – returns the status of the collection
+func (t *DC) GetStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := getDCRecord(stub, args[0])
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return []byte(record.Status), nil
+}
+
+// checkCollectionDocs validates the shipping documents of a collection with the document contracts,
+// without the LC rules, and checks them against the collection instruction
+func (t *TF) checkCollectionDocs(stub shim.ChaincodeStubInterface, instruction DC, BLJSON string, invoiceJSON string, packingListJSON string) error {
+	validate := func(docType string, docJSON string, validator func(shim.ChaincodeStubInterface, []string) ([]byte, error)) error {
+		if docJSON == "" || docJSON == "{}" {
+			return nil
+		}
+		res, err := validator(stub, []string{docJSON, ""})
+		if err != nil {
+			return err
+		}
+		if strings.Contains(string(res), "Error") {
+			return errors.New(docType + " validation failed. " + string(res))
+		}
+		return nil
+	}
+	err := validate("BL", BLJSON, t.bl.ValidateDoc)
+	if err != nil {
+		return err
+	}
+	err = validate("Invoice", invoiceJSON, t.invoice.ValidateDoc)
+	if err != nil {
+		return err
+	}
+	err = validate("Packing list", packingListJSON, t.pl.ValidateDoc)
+	if err != nil {
+		return err
+	}
+
+	if BLJSON != "" && BLJSON != "{}" {
+		var bl BL
+		json.Unmarshal([]byte(BLJSON), &bl)
+		if bl.CURRENCY != instruction.Currency {
+			return errors.New("Currency in BL does not match the collection currency " + instruction.Currency)
+		}
+	}
+	if invoiceJSON != "" && invoiceJSON != "{}" {
+		var invoice Invoice
+		json.Unmarshal([]byte(invoiceJSON), &invoice)
+		if invoice.CURRENCY != instruction.Currency {
+			return errors.New("Currency in invoice does not match the collection currency " + instruction.Currency)
+		}
+		amount, _ := parseDecimal(instruction.Amount)
+		if !amountsEqual(float64(invoice.TOTAL_IN_FIGURES), amount) {
+			return fmt.Errorf("Invoice total %d does not match the collection amount %s", invoice.TOTAL_IN_FIGURES, instruction.Amount)
+		}
+	}
+	return nil
+}
+
+// sendCollectionDocuments stores the documents of a collection and marks them sent to the collecting bank.
+// args: UID, BLPDF, invoicePDF, packingListPDF, BLJSON, invoiceJSON, packingListJSON
+func (t *TF) sendCollectionDocuments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 7 {
+		return nil, fmt.Errorf("Incorrect number of arguments. Expecting 7. Got: %d.", len(args))
+	}
+
+	contractID := args[0]
+	record, err := getDCRecord(stub, contractID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("No collection exists for " + contractID)
+	}
+	if record.Status != DC_INSTRUCTED {
+		return nil, errors.New("Documents of collection " + contractID + " have already been sent")
+	}
+
+	err = t.checkCollectionDocs(stub, record.Instruction, args[4], args[5], args[6])
+	if err != nil {
+		return nil, err
+	}
+
+	docs := []struct {
+		docType string
+		submit  func(shim.ChaincodeStubInterface, []string) ([]byte, error)
+		docJSON string
+		docPDF  string
+	}{
+		{"BL", t.bl.SubmitDoc, args[4], args[1]},
+		{"INVOICE", t.invoice.SubmitDoc, args[5], args[2]},
+		{"PACKINGLIST", t.pl.SubmitDoc, args[6], args[3]},
+	}
+	for _, doc := range docs {
+		if doc.docJSON == "" && doc.docPDF == "" {
+			continue
+		}
+		ref, err := storeDocument(stub, contractID, doc.docType, doc.docPDF)
+		if err != nil {
+			return nil, err
+		}
+		_, err = doc.submit(stub, []string{contractID, doc.docJSON, ref})
+		if err != nil {
+			return nil, err
+		}
+		err = recordFingerprints(stub, contractID, doc.docType, doc.docJSON, doc.docPDF, record.Instruction.RemittingBank, "RemittingBank")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return t.dc.updateStatus(stub, []string{contractID, DC_DOCUMENTS_SENT, "RemittingBank", ""})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CONFIRMATION prefixes the confirmation added to an LC: CONFIRMATION + UID
+const CONFIRMATION = "CONFIRM~"
+
+// Confirmation states
+const (
+	CONFIRMATION_CONFIRMED  = "CONFIRMED"
+	CONFIRMATION_DISCHARGED = "DISCHARGED"              // the issuing bank paid
+	CONFIRMATION_CALLED     = "CALLED"                  // the issuing bank defaulted, the confirming bank must pay
+	CONFIRMATION_PAID       = "PAID_BY_CONFIRMING_BANK" // the confirming bank paid
+)
+
+// Confirmation is the confirming bank's own undertaking to pay under an LC
+type Confirmation struct {
+	ContractID      string
+	ConfirmingBank  string
+	Instruction     string // Tag49 of the LC
+	Currency        string
+	ConfirmedAmount float64
+	Fee             float64
+	FeePercentage   float64 `json:",omitempty"`
+	ConfirmedOn     string
+	Status          string
+	Liability       *Settlement `json:",omitempty"` // what the confirming bank owes once called
+}
+
+func getConfirmation(stub shim.ChaincodeStubInterface, UID string) (*Confirmation, error) {
+	recBytes, err := stub.GetState(CONFIRMATION + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + CONFIRMATION + UID)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var confirmation Confirmation
+	err = json.Unmarshal(recBytes, &confirmation)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal confirmation of " + UID)
+	}
+	return &confirmation, nil
+}
+
+func putConfirmation(stub shim.ChaincodeStubInterface, confirmation *Confirmation) error {
+	recBytes, _ := json.Marshal(confirmation)
+	return stub.PutState(CONFIRMATION+confirmation.ContractID, recBytes)
+}
+
+// isLCConfirmed tells whether a confirming bank has added its undertaking to an LC
+func isLCConfirmed(stub shim.ChaincodeStubInterface, UID string) (bool, error) {
+	confirmation, err := getConfirmation(stub, UID)
+	return confirmation != nil, err
+}
+
+// withConfirmedFlag adds CONFIRMED, whether a confirming bank has added its undertaking, to the JSON of an LC
+func withConfirmedFlag(stub shim.ChaincodeStubInterface, UID string, lcJSON []byte) ([]byte, error) {
+	if len(lcJSON) == 0 {
+		return lcJSON, nil
+	}
+	confirmed, err := isLCConfirmed(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	lc, err := decodeDocument(lcJSON)
+	if err != nil {
+		return nil, err
+	}
+	lc["CONFIRMED"] = confirmed
+	return json.Marshal(lc)
+}
+
+// confirmLC adds the exporter bank's confirmation to an LC whose Tag49 is CONFIRM or MAY ADD.
+// args: UID, confirmed amount (empty for the full credit amount), fee as an amount or a percentage such as "0.5%"
+func (t *TF) confirmLC(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	UID := args[0]
+	existing, err := getConfirmation(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("LC " + UID + " has already been confirmed")
+	}
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) != "ACCEPTED_BY_EB" {
+		return nil, errors.New("Only an LC accepted by the exporter bank can be confirmed")
+	}
+
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	err = requireDecrypted(UID, lcJSON)
+	if err != nil {
+		return nil, err
+	}
+	var lc LC
+	err = json.Unmarshal(lcJSON, &lc)
+	if err != nil {
+		return nil, err
+	}
+	instruction := strings.ToUpper(strings.TrimSpace(lc.Tag49))
+	if instruction != "CONFIRM" && instruction != "MAY ADD" {
+		return nil, errors.New("Tag49 of the LC is " + lc.Tag49 + "; confirmation may not be added")
+	}
+
+	currency, amount, err := parseTag32B(lc.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	confirmation := Confirmation{ContractID: UID, Instruction: instruction, Currency: currency, ConfirmedAmount: amount, Status: CONFIRMATION_CONFIRMED}
+	if args[1] != "" {
+		confirmation.ConfirmedAmount, err = parseDecimal(args[1])
+		if err != nil || confirmation.ConfirmedAmount <= 0 || confirmation.ConfirmedAmount > amount {
+			return nil, errors.New("Confirmed amount should be a positive number no greater than the credit amount " + lc.Tag32B)
+		}
+	}
+
+	fee := args[2]
+	if len(fee) > 0 && fee[len(fee)-1] == '%' {
+		confirmation.FeePercentage, err = strconv.ParseFloat(fee[:len(fee)-1], 64)
+		if err != nil || confirmation.FeePercentage < 0 || confirmation.FeePercentage > 100 {
+			return nil, errors.New("Fee percentage should be between 0 and 100")
+		}
+		confirmation.Fee = math.Floor(confirmation.ConfirmedAmount*confirmation.FeePercentage+0.5) / 100
+	} else if fee != "" {
+		confirmation.Fee, err = parseDecimal(fee)
+		if err != nil || confirmation.Fee < 0 {
+			return nil, errors.New("Fee should be an amount or a percentage")
+		}
+	}
+
+	row, err := getContractRow(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	confirmation.ConfirmingBank = row.Columns[6].GetString_()
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	confirmation.ConfirmedOn = now.Format(time_format)
+
+	err = putConfirmation(stub, &confirmation)
+	if err != nil {
+		return nil, err
+	}
+	if confirmation.Fee > 0 {
+		err = t.addCharge(stub, UID, CHARGE_CONFIRMATION, "ExporterBank", currency, confirmation.Fee, "")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, t.updateContractSummary(stub, UID)
+}
+
+// dischargeConfirmation releases the confirming bank once the issuing bank has paid
+func dischargeConfirmation(stub shim.ChaincodeStubInterface, UID string) error {
+	confirmation, err := getConfirmation(stub, UID)
+	if err != nil || confirmation == nil || confirmation.Status != CONFIRMATION_CONFIRMED {
+		return err
+	}
+	confirmation.Status = CONFIRMATION_DISCHARGED
+	return putConfirmation(stub, confirmation)
+}
+
+// callConfirmation makes the confirming bank liable for the unpaid principal, up to the confirmed amount,
+// when the issuing bank defaults
+func callConfirmation(stub shim.ChaincodeStubInterface, UID string, principal float64, dueDate string) error {
+	confirmation, err := getConfirmation(stub, UID)
+	if err != nil || confirmation == nil || confirmation.Status != CONFIRMATION_CONFIRMED {
+		return err
+	}
+	liable := principal
+	if liable > confirmation.ConfirmedAmount {
+		liable = confirmation.ConfirmedAmount
+	}
+	confirmation.Status = CONFIRMATION_CALLED
+	confirmation.Liability = &Settlement{
+		ContractID:   UID,
+		ContractType: "LC",
+		Currency:     confirmation.Currency,
+		AmountDue:    liable,
+		Outstanding:  liable,
+		DueDate:      dueDate,
+		Status:       SETTLEMENT_OPEN,
+		Payments:     make([]Payment, 0),
+	}
+	return putConfirmation(stub, confirmation)
+}
+
+// payUnderConfirmation books the confirming bank's payment to the beneficiary after the issuing bank defaulted.
+// Once the liability is met the proceeds are paid out as they would have been by the issuing bank. args: UID, payment JSON
+func (t *TF) payUnderConfirmation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+
+	confirmation, err := getConfirmation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if confirmation == nil || confirmation.Status != CONFIRMATION_CALLED {
+		return nil, errors.New("The confirmation of " + args[0] + " has not been called")
+	}
+	payment, err := parsePayment(args[1])
+	if err != nil {
+		return nil, err
+	}
+	err = confirmation.Liability.addPayment(stub, *payment)
+	if err != nil {
+		return nil, err
+	}
+	if confirmation.Liability.Status != SETTLEMENT_SETTLED {
+		return nil, putConfirmation(stub, confirmation)
+	}
+
+	confirmation.Status = CONFIRMATION_PAID
+	err = putConfirmation(stub, confirmation)
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.distributeProceeds(stub, args[0], confirmation.Currency, confirmation.Liability.Paid)
+	return nil, err
+}
+
+// getConfirmation returns the confirmation of an LC; args: UID
+func (t *TF) getConfirmation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	confirmation, err := getConfirmation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if confirmation == nil {
+		return nil, errors.New("LC " + args[0] + " has not been confirmed")
+	}
+	return json.Marshal(confirmation)
+}
@@ -0,0 +1,469 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CONTRACT_SUMMARY prefixes the summary kept for every contract in BPTable: CONTRACT_SUMMARY~<UID>
+const CONTRACT_SUMMARY = "CS"
+
+// CONTRACT_INDEX prefixes the sorted indexes of the summaries: CONTRACT_INDEX~<scope>~<sort field>~<A|D>~<sort key>.
+// The scope is empty for the index of all contracts and a participant name for that participant's contracts.
+// Each entry holds the contract ID.
+const CONTRACT_INDEX = "CSI"
+
+// contractSortFields are the fields searchContracts can sort by; every one is indexed in both orders
+var contractSortFields = []string{"ContractID", "IssueDate", "Amount", "Status"}
+
+const defaultPageSize = 20
+const maxPageSize = 200
+
+// ContractSummary holds the searchable fields of a contract so that searchContracts does not have to read
+// the LC and export documents of every contract
+type ContractSummary struct {
+	ContractID       string
+	ContractStatus   string
+	LCStatus         string
+	EDStatus         string
+	Comment          string
+	ImporterName     string
+	ExporterName     string
+	ImporterBankName string
+	ExporterBankName string
+	ShippingCompany  string
+	InsuranceCompany string
+	LCNumber         string
+	IssueDate        string
+	Currency         string
+	Amount           float64
+	POContractId     string `json:"POContractId,omitempty"`
+	TransferredFrom  string `json:"TransferredFrom,omitempty"`
+	Confirmed        bool
+	ScreeningStatus  string `json:"ScreeningStatus,omitempty"`
+}
+
+// ContractSearch is the JSON argument of searchContracts. Empty fields do not filter.
+// Dates are mm/dd/yyyy and compared with the LC date of issue (Tag31C).
+type ContractSearch struct {
+	Participant string
+	Role        string
+	LCStatus    string
+	EDStatus    string
+	IssuedFrom  string
+	IssuedTo    string
+	Currency    string
+	MinAmount   float64
+	MaxAmount   float64
+	SortBy      string
+	SortOrder   string
+	PageSize    int
+	Bookmark    string
+}
+
+// ContractPage is one page of searchContracts results. Bookmark is empty on the last page.
+type ContractPage struct {
+	Contracts []ContractSummary
+	Count     int
+	Bookmark  string
+}
+
+func contractSummaryKey(UID string) string {
+	return CONTRACT_SUMMARY + "~" + UID
+}
+
+func contractIndexPrefix(scope string, sortBy string, descending bool) string {
+	order := "A"
+	if descending {
+		order = "D"
+	}
+	return CONTRACT_INDEX + "~" + scope + "~" + sortBy + "~" + order + "~"
+}
+
+// descendingKey turns a sort key into one that orders the other way round. Keys are printable ASCII:
+// each byte is mirrored within that range and the terminator puts a key after the keys it is a prefix of.
+func descendingKey(key string) string {
+	b := make([]byte, len(key)+1)
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if c < 0x20 {
+			c = 0x20
+		} else if c > 0x7e {
+			c = 0x7e
+		}
+		b[i] = 0x9e - c
+	}
+	b[len(key)] = 0x7f
+	return string(b)
+}
+
+// participantRoles returns the participant names of a contract by role
+func (s *ContractSummary) participantRoles() map[string]string {
+	return map[string]string{
+		"Importer":         s.ImporterName,
+		"Exporter":         s.ExporterName,
+		"ImporterBank":     s.ImporterBankName,
+		"ExporterBank":     s.ExporterBankName,
+		"ShippingCompany":  s.ShippingCompany,
+		"InsuranceCompany": s.InsuranceCompany,
+	}
+}
+
+// indexKeys returns the sorted index entries of a contract summary, for all contracts and for each participant
+func (s *ContractSummary) indexKeys() map[string]bool {
+	keys := make(map[string]bool)
+	if s == nil {
+		return keys
+	}
+	scopes := []string{""}
+	for _, name := range s.participantRoles() {
+		if name != "" {
+			scopes = append(scopes, name)
+		}
+	}
+	for _, scope := range scopes {
+		for _, sortBy := range contractSortFields {
+			key := s.sortKey(sortBy)
+			keys[contractIndexPrefix(scope, sortBy, false)+key] = true
+			keys[contractIndexPrefix(scope, sortBy, true)+descendingKey(key)] = true
+		}
+	}
+	return keys
+}
+
+// getContractSummary reads the summary of a contract; nil if none has been written yet
+func getContractSummary(stub shim.ChaincodeStubInterface, UID string) (*ContractSummary, error) {
+	recBytes, err := stub.GetState(contractSummaryKey(UID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get contract summary for %s. Error %s", UID, err.Error())
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var summary ContractSummary
+	err = json.Unmarshal(recBytes, &summary)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal contract summary for %s", UID)
+	}
+	return &summary, nil
+}
+
+// updateContractSummary recomputes the summary of a contract from BPTable, the LC and the export documents
+func (t *TF) updateContractSummary(stub shim.ChaincodeStubInterface, UID string) error {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: "BP"}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: UID}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("BPTable", columns)
+	if err != nil {
+		return fmt.Errorf("Error: Failed retrieving document with ContractNo %s. Error %s", UID, err.Error())
+	}
+	if len(row.Columns) == 0 {
+		return nil
+	}
+
+	var summary ContractSummary
+	summary.ContractID = UID
+	summary.ImporterName = row.Columns[3].GetString_()
+	summary.ExporterName = row.Columns[4].GetString_()
+	summary.ImporterBankName = row.Columns[5].GetString_()
+	summary.ExporterBankName = row.Columns[6].GetString_()
+	summary.ShippingCompany = row.Columns[11].GetString_()
+	summary.InsuranceCompany = row.Columns[12].GetString_()
+
+	b, c, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return err
+	}
+	summary.LCStatus = string(b)
+	summary.Comment = string(c)
+
+	b1, err := t.bl.GetStatus(stub, []string{UID})
+	if err != nil {
+		return err
+	}
+	summary.EDStatus = string(b1)
+
+	// Same rule as listContracts: once the LC is accepted the export documents drive the contract status
+	summary.ContractStatus = summary.LCStatus
+	if summary.LCStatus == "ACCEPTED_BY_EB" && summary.EDStatus != "" {
+		summary.ContractStatus = summary.EDStatus
+	}
+
+	// Read the LC as stored: fields the parties keep encrypted stay out of the summary
+	lcJSON, err := t.lc.getStoredJSON(stub, []string{UID})
+	if err != nil {
+		return err
+	}
+	var lc LC
+	if json.Unmarshal(lcJSON, &lc) == nil {
+		summary.LCNumber = lc.Tag20
+		summary.IssueDate = lc.Tag31C
+		summary.Currency, summary.Amount, _ = parseTag32B(lc.Tag32B)
+	}
+
+	summary.POContractId, err = getLinkedPONumber(stub, UID)
+	if err != nil {
+		return err
+	}
+	summary.TransferredFrom, err = getTransferParent(stub, UID)
+	if err != nil {
+		return err
+	}
+	summary.Confirmed, err = isLCConfirmed(stub, UID)
+	if err != nil {
+		return err
+	}
+	// a contract held or blocked by sanctions screening shows that instead of its document status
+	summary.ScreeningStatus, err = screeningStatus(stub, "LC", UID)
+	if err != nil {
+		return err
+	}
+	if summary.ScreeningStatus == SCREENING_HOLD || summary.ScreeningStatus == SCREENING_BLOCKED {
+		summary.ContractStatus = summary.ScreeningStatus
+	}
+
+	previous, err := getContractSummary(stub, UID)
+	if err != nil {
+		return err
+	}
+	summaryBytes, _ := json.Marshal(summary)
+	err = stub.PutState(contractSummaryKey(UID), summaryBytes)
+	if err != nil {
+		return err
+	}
+
+	oldKeys := previous.indexKeys()
+	newKeys := summary.indexKeys()
+	for key := range oldKeys {
+		if !newKeys[key] {
+			err = stub.DelState(key)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	for key := range newKeys {
+		if !oldKeys[key] {
+			err = stub.PutState(key, []byte(UID))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// reindexContracts writes the summary of every contract in BPTable. Needed once for contracts created before searchContracts.
+func (t *TF) reindexContracts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: "BP"}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("BPTable", columns)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to retrieve row")
+	}
+
+	var contractIDs []string
+	for row := range rows {
+		if len(row.Columns) != 0 {
+			contractIDs = append(contractIDs, row.Columns[1].GetString_())
+		}
+	}
+	for _, UID := range contractIDs {
+		err = t.updateContractSummary(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, nil
+}
+
+// matches reports whether a contract summary passes every filter of the search
+func (q *ContractSearch) matches(s *ContractSummary, issuedFrom time.Time, issuedTo time.Time) bool {
+	if q.Participant != "" {
+		roles := s.participantRoles()
+		if q.Role != "" {
+			if roles[q.Role] != q.Participant {
+				return false
+			}
+		} else {
+			found := false
+			for _, name := range roles {
+				if name == q.Participant {
+					found = true
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+	}
+	if q.LCStatus != "" && q.LCStatus != s.LCStatus {
+		return false
+	}
+	if q.EDStatus != "" && q.EDStatus != s.EDStatus {
+		return false
+	}
+	if q.Currency != "" && q.Currency != s.Currency {
+		return false
+	}
+	if q.MinAmount > 0 && s.Amount < q.MinAmount {
+		return false
+	}
+	if q.MaxAmount > 0 && s.Amount > q.MaxAmount {
+		return false
+	}
+	if !issuedFrom.IsZero() || !issuedTo.IsZero() {
+		issued, err := time.Parse(time_format, s.IssueDate)
+		if err != nil {
+			return false
+		}
+		if !issuedFrom.IsZero() && issued.Before(issuedFrom) {
+			return false
+		}
+		if !issuedTo.IsZero() && issued.After(issuedTo) {
+			return false
+		}
+	}
+	return true
+}
+
+// sortKey returns a string that orders contract summaries by the given field, ties broken by contract ID.
+// The space separating the two sorts before anything the field holds.
+func (s *ContractSummary) sortKey(sortBy string) string {
+	key := ""
+	switch sortBy {
+	case "IssueDate":
+		issued, err := time.Parse(time_format, s.IssueDate)
+		if err == nil {
+			key = issued.Format("20060102")
+		}
+	case "Amount":
+		key = fmt.Sprintf("%020.2f", s.Amount)
+	case "Status":
+		key = s.ContractStatus
+	default:
+		return s.ContractID
+	}
+	return key + " " + s.ContractID
+}
+
+// searchContracts returns one page of contract summaries matching the ContractSearch given as JSON in args[0].
+// Pass the Bookmark of a page in the next search to get the following page.
+func (t *TF) searchContracts(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	var q ContractSearch
+	err := json.Unmarshal([]byte(args[0]), &q)
+	if err != nil {
+		return nil, errors.New("Search criteria should be a JSON object " + err.Error())
+	}
+
+	if q.Role != "" && q.Role != "Importer" && q.Role != "Exporter" && q.Role != "ImporterBank" && q.Role != "ExporterBank" && q.Role != "ShippingCompany" && q.Role != "InsuranceCompany" {
+		return nil, errors.New("Role should be Importer, Exporter, ImporterBank, ExporterBank, ShippingCompany or InsuranceCompany.")
+	}
+	if q.Role != "" && q.Participant == "" {
+		return nil, errors.New("Role can only be used together with Participant.")
+	}
+	if q.SortBy != "" && q.SortBy != "ContractID" && q.SortBy != "IssueDate" && q.SortBy != "Amount" && q.SortBy != "Status" {
+		return nil, errors.New("SortBy should be ContractID, IssueDate, Amount or Status.")
+	}
+	if q.SortOrder != "" && q.SortOrder != "ASC" && q.SortOrder != "DESC" {
+		return nil, errors.New("SortOrder should be ASC or DESC.")
+	}
+	if q.PageSize <= 0 {
+		q.PageSize = defaultPageSize
+	} else if q.PageSize > maxPageSize {
+		q.PageSize = maxPageSize
+	}
+
+	var issuedFrom, issuedTo time.Time
+	if q.IssuedFrom != "" {
+		issuedFrom, err = time.Parse(time_format, q.IssuedFrom)
+		if err != nil {
+			return nil, errors.New("Incorrect date format for IssuedFrom. Expecting mm/dd/yyyy")
+		}
+	}
+	if q.IssuedTo != "" {
+		issuedTo, err = time.Parse(time_format, q.IssuedTo)
+		if err != nil {
+			return nil, errors.New("Incorrect date format for IssuedTo. Expecting mm/dd/yyyy")
+		}
+	}
+
+	after := ""
+	if q.Bookmark != "" {
+		decoded, err := base64.URLEncoding.DecodeString(q.Bookmark)
+		if err != nil {
+			return nil, errors.New("Invalid bookmark")
+		}
+		after = string(decoded)
+	}
+
+	// The index of the participant, or of all contracts, in the requested order is read from just after
+	// the last contract of the previous page
+	sortBy := q.SortBy
+	if sortBy == "" {
+		sortBy = "ContractID"
+	}
+	prefix := contractIndexPrefix(q.Participant, sortBy, q.SortOrder == "DESC")
+	start := prefix
+	if after != "" {
+		start = prefix + after + "\x00"
+	}
+	// '\x7f' sorts directly after the '~' that ends the prefix
+	iter, err := stub.RangeQueryState(start, prefix[:len(prefix)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query contract summaries")
+	}
+	defer iter.Close()
+
+	var page ContractPage
+	page.Contracts = make([]ContractSummary, 0)
+	last := ""
+	for iter.HasNext() {
+		key, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to read contract summaries")
+		}
+
+		summary, err := getContractSummary(stub, string(value))
+		if err != nil {
+			return nil, err
+		}
+		if summary == nil || !q.matches(summary, issuedFrom, issuedTo) {
+			continue
+		}
+
+		if accessControlFlag == true {
+			res, err := t.isCallerParticipant(stub, []string{summary.ContractID})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				continue
+			}
+		}
+		// a further match means there is another page
+		if len(page.Contracts) == q.PageSize {
+			page.Bookmark = base64.URLEncoding.EncodeToString([]byte(last))
+			break
+		}
+		page.Contracts = append(page.Contracts, *summary)
+		last = key[len(prefix):]
+	}
+	page.Count = len(page.Contracts)
+
+	return json.Marshal(page)
+}
@@ -0,0 +1,403 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// CREDIT_LIMIT prefixes the limits a bank sets: CREDIT_LIMIT + bank~type~counterparty
+const CREDIT_LIMIT = "LIMIT~"
+
+// EXPOSURE prefixes the exposure an LC reserves against its issuing bank's limits: EXPOSURE + UID
+const EXPOSURE = "EXPOSURE~"
+
+// Limit types
+const (
+	LIMIT_APPLICANT = "APPLICANT"
+	LIMIT_BANK      = "BANK"
+)
+
+// Exposure states
+const (
+	EXPOSURE_RESERVED = "RESERVED"
+	EXPOSURE_RELEASED = "RELEASED"
+)
+
+// CreditLimit is how much a bank will have outstanding on LCs for one applicant or with one counterparty bank
+type CreditLimit struct {
+	Bank         string
+	Type         string
+	Counterparty string
+	Currency     string
+	Limit        float64
+	Utilised     float64
+	Contracts    map[string]float64 // exposure reserved per contract
+}
+
+// Exposure is what an LC may draw on its issuing bank: the credit amount with the upper tolerance
+type Exposure struct {
+	ContractID       string
+	Bank             string
+	Applicant        string
+	CounterpartyBank string
+	Currency         string
+	Amount           float64
+	Status           string
+	ReleasedOn       string `json:",omitempty"`
+	Reason           string `json:",omitempty"`
+}
+
+// LimitUsage reports a limit with what is left of it
+type LimitUsage struct {
+	CreditLimit
+	Available float64
+}
+
+// ExposureReport lists a bank's limits and outstanding LCs with the total exposure per currency
+type ExposureReport struct {
+	Bank      string
+	Limits    []LimitUsage
+	Exposures []Exposure
+	Exposure  map[string]float64
+}
+
+func creditLimitKey(bank string, limitType string, counterparty string) string {
+	return CREDIT_LIMIT + bank + "~" + limitType + "~" + counterparty
+}
+
+func getCreditLimit(stub shim.ChaincodeStubInterface, bank string, limitType string, counterparty string) (*CreditLimit, error) {
+	key := creditLimitKey(bank, limitType, counterparty)
+	recBytes, err := stub.GetState(key)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + key)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var limit CreditLimit
+	err = json.Unmarshal(recBytes, &limit)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal credit limit " + key)
+	}
+	if limit.Contracts == nil {
+		limit.Contracts = map[string]float64{}
+	}
+	return &limit, nil
+}
+
+func putCreditLimit(stub shim.ChaincodeStubInterface, limit *CreditLimit) error {
+	recBytes, _ := json.Marshal(limit)
+	return stub.PutState(creditLimitKey(limit.Bank, limit.Type, limit.Counterparty), recBytes)
+}
+
+func getExposure(stub shim.ChaincodeStubInterface, UID string) (*Exposure, error) {
+	recBytes, err := stub.GetState(EXPOSURE + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + EXPOSURE + UID)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var exposure Exposure
+	err = json.Unmarshal(recBytes, &exposure)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal exposure of " + UID)
+	}
+	return &exposure, nil
+}
+
+func putExposure(stub shim.ChaincodeStubInterface, exposure *Exposure) error {
+	recBytes, _ := json.Marshal(exposure)
+	return stub.PutState(EXPOSURE+exposure.ContractID, recBytes)
+}
+
+// exposureLimits returns the applicant and counterparty bank limits an exposure counts against; either may be nil
+func exposureLimits(stub shim.ChaincodeStubInterface, exposure *Exposure) ([]*CreditLimit, error) {
+	applicantLimit, err := getCreditLimit(stub, exposure.Bank, LIMIT_APPLICANT, exposure.Applicant)
+	if err != nil {
+		return nil, err
+	}
+	bankLimit, err := getCreditLimit(stub, exposure.Bank, LIMIT_BANK, exposure.CounterpartyBank)
+	if err != nil {
+		return nil, err
+	}
+	limits := make([]*CreditLimit, 0)
+	for _, limit := range []*CreditLimit{applicantLimit, bankLimit} {
+		if limit != nil {
+			limits = append(limits, limit)
+		}
+	}
+	return limits, nil
+}
+
+// setCreditLimit sets a bank's limit for an applicant or a counterparty bank;
+// args: bank, APPLICANT|BANK, applicant or counterparty bank name, limit as currency and amount e.g. "USD1000000"
+func (t *TF) setCreditLimit(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+	if args[0] == "" || args[2] == "" {
+		return nil, errors.New("Bank and counterparty: required fields not provided")
+	}
+	limitType := strings.ToUpper(args[1])
+	if limitType != LIMIT_APPLICANT && limitType != LIMIT_BANK {
+		return nil, errors.New("Limit type should be APPLICANT or BANK")
+	}
+	currency, amount, err := parseTag32B(args[3])
+	if err != nil {
+		return nil, err
+	}
+	if !isoCurrencyCodes[currency] {
+		return nil, errors.New("Limit currency " + currency + " is not an ISO 4217 currency code")
+	}
+
+	limit, err := getCreditLimit(stub, args[0], limitType, args[2])
+	if err != nil {
+		return nil, err
+	}
+	if limit == nil {
+		limit = &CreditLimit{Bank: args[0], Type: limitType, Counterparty: args[2], Contracts: map[string]float64{}}
+	} else if limit.Utilised > 0 && limit.Currency != currency {
+		return nil, errors.New("The limit has exposure in " + limit.Currency + "; its currency cannot change")
+	}
+	limit.Currency = currency
+	limit.Limit = amount
+	return nil, putCreditLimit(stub, limit)
+}
+
+// isCallerBank checks that the caller holds the certificate a bank was given on any of its contracts,
+// as importer bank or exporter bank
+func (t *TF) isCallerBank(stub shim.ChaincodeStubInterface, bank string) (bool, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: "BP"}}
+	columns = append(columns, col1)
+
+	rows, err := stub.GetRows("BPTable", columns)
+	if err != nil {
+		return false, errors.New("Failed to retrieve contracts")
+	}
+	certificates := make([][]byte, 0)
+	for row := range rows {
+		if len(row.Columns) == 0 {
+			continue
+		}
+		if row.Columns[5].GetString_() == bank {
+			certificates = append(certificates, row.Columns[9].GetBytes())
+		}
+		if row.Columns[6].GetString_() == bank {
+			certificates = append(certificates, row.Columns[10].GetBytes())
+		}
+	}
+	for _, certificate := range certificates {
+		ok, err := t.isCaller(stub, certificate)
+		if err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// newExposure works out what an LC may draw on its issuing bank from the LC JSON as submitted
+func newExposure(UID string, lcJSON string, applicant string, bank string, counterpartyBank string) (*Exposure, error) {
+	var lc LC
+	err := json.Unmarshal([]byte(lcJSON), &lc)
+	if err != nil {
+		return nil, err
+	}
+	currency, amount, err := parseTag32B(lc.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	tolerance, err := upperTolerance(lc.Tag39A)
+	if err != nil {
+		return nil, err
+	}
+	return &Exposure{
+		ContractID:       UID,
+		Bank:             bank,
+		Applicant:        applicant,
+		CounterpartyBank: counterpartyBank,
+		Currency:         currency,
+		Amount:           amount * (1 + tolerance/100),
+		Status:           EXPOSURE_RESERVED,
+	}, nil
+}
+
+// reserveExposure reserves the exposure of an LC against its issuing bank's limits, replacing what it
+// reserved before when the LC is resubmitted. It fails if a limit would be exceeded.
+func reserveExposure(stub shim.ChaincodeStubInterface, exposure *Exposure) error {
+	UID := exposure.ContractID
+	limits, err := exposureLimits(stub, exposure)
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		if limit.Currency != exposure.Currency {
+			return errors.New("The " + strings.ToLower(limit.Type) + " limit of " + limit.Bank + " for " + limit.Counterparty + " is in " + limit.Currency + "; the LC is in " + exposure.Currency)
+		}
+		utilised := limit.Utilised - limit.Contracts[UID] + exposure.Amount
+		if utilised > limit.Limit+0.005 {
+			return fmt.Errorf("Credit limit exceeded: the %s limit of %s for %s is %s %.2f with %.2f available; the LC needs %.2f",
+				strings.ToLower(limit.Type), limit.Bank, limit.Counterparty, limit.Currency, limit.Limit, limit.Limit-limit.Utilised+limit.Contracts[UID], exposure.Amount)
+		}
+		limit.Utilised = utilised
+		limit.Contracts[UID] = exposure.Amount
+		err = putCreditLimit(stub, limit)
+		if err != nil {
+			return err
+		}
+	}
+	return putExposure(stub, exposure)
+}
+
+// releaseExposure gives the exposure of an LC back to its issuing bank's limits
+func releaseExposure(stub shim.ChaincodeStubInterface, UID string, reason string) error {
+	exposure, err := getExposure(stub, UID)
+	if err != nil || exposure == nil || exposure.Status != EXPOSURE_RESERVED {
+		return err
+	}
+	limits, err := exposureLimits(stub, exposure)
+	if err != nil {
+		return err
+	}
+	for _, limit := range limits {
+		limit.Utilised -= limit.Contracts[UID]
+		if limit.Utilised < 0.005 {
+			limit.Utilised = 0
+		}
+		delete(limit.Contracts, UID)
+		err = putCreditLimit(stub, limit)
+		if err != nil {
+			return err
+		}
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	exposure.Status = EXPOSURE_RELEASED
+	exposure.ReleasedOn = now.Format(time_format)
+	exposure.Reason = reason
+	return putExposure(stub, exposure)
+}
+
+// releaseExpiredExposures releases the exposure a bank holds on LCs that expired without anything falling
+// due under them; args: bank
+func (t *TF) releaseExpiredExposures(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse(time_format, now.Format(time_format))
+
+	// '\x7f' sorts directly after the '~' that ends the prefix
+	iter, err := stub.RangeQueryState(EXPOSURE, EXPOSURE[:len(EXPOSURE)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query exposures")
+	}
+	expired := make([]string, 0)
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, errors.New("Failed to read exposures")
+		}
+		var exposure Exposure
+		if json.Unmarshal(value, &exposure) == nil && exposure.Status == EXPOSURE_RESERVED && exposure.Bank == args[0] {
+			expired = append(expired, exposure.ContractID)
+		}
+	}
+	iter.Close()
+
+	released := make([]string, 0)
+	for _, UID := range expired {
+		status, _, err := t.lc.GetStatus(stub, []string{UID})
+		if err != nil {
+			return nil, err
+		}
+		if string(status) == "PAYMENT_DUE_FROM_IB_TO_EB" || string(status) == "PAYMENT_DEFAULTED" {
+			continue
+		}
+		// the expiry date is not a sensitive field, so the LC can be read as stored
+		lcJSON, err := t.lc.getStoredJSON(stub, []string{UID})
+		if err != nil {
+			return nil, err
+		}
+		var lc LC
+		if json.Unmarshal(lcJSON, &lc) != nil {
+			continue
+		}
+		expiry, err := tag31DDate(lc.Tag31D)
+		if err != nil || !today.After(expiry) {
+			continue
+		}
+		err = releaseExposure(stub, UID, "EXPIRED")
+		if err != nil {
+			return nil, err
+		}
+		released = append(released, UID)
+	}
+	return json.Marshal(released)
+}
+
+// getExposureReport returns a bank's limits with what is used and left of each, and its outstanding LCs
+// with the total exposure per currency; args: bank
+func (t *TF) getExposureReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	report := ExposureReport{Bank: args[0], Limits: make([]LimitUsage, 0), Exposures: make([]Exposure, 0), Exposure: map[string]float64{}}
+	prefix := CREDIT_LIMIT + args[0] + "~"
+	iter, err := stub.RangeQueryState(prefix, prefix[:len(prefix)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query credit limits")
+	}
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			iter.Close()
+			return nil, errors.New("Failed to read credit limits")
+		}
+		var limit CreditLimit
+		err = json.Unmarshal(value, &limit)
+		if err != nil {
+			iter.Close()
+			return nil, err
+		}
+		report.Limits = append(report.Limits, LimitUsage{CreditLimit: limit, Available: limit.Limit - limit.Utilised})
+	}
+	iter.Close()
+
+	iter, err = stub.RangeQueryState(EXPOSURE, EXPOSURE[:len(EXPOSURE)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query exposures")
+	}
+	defer iter.Close()
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to read exposures")
+		}
+		var exposure Exposure
+		err = json.Unmarshal(value, &exposure)
+		if err != nil {
+			return nil, err
+		}
+		if exposure.Bank != args[0] || exposure.Status != EXPOSURE_RESERVED {
+			continue
+		}
+		report.Exposures = append(report.Exposures, exposure)
+		report.Exposure[exposure.Currency] += exposure.Amount
+	}
+	return json.Marshal(report)
+}
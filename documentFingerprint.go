@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// DOC_FINGERPRINT prefixes the fingerprints of a contract document: DOC_FINGERPRINT~<contractID>~<docType>
+const DOC_FINGERPRINT = "DFP"
+
+// DocumentFingerprint records the hash of one document payload as it was submitted
+type DocumentFingerprint struct {
+	DocType        string
+	Format         string
+	Version        int
+	SHA256         string
+	Submitter      string
+	SubmitterRole  string
+	CallerCertHash string `json:"CallerCertHash,omitempty"`
+	TxID           string
+	Timestamp      string
+}
+
+func fingerprintKey(contractID string, docType string) string {
+	return DOC_FINGERPRINT + "~" + contractID + "~" + docType
+}
+
+// canonicalJSON returns a JSON document with sorted keys, no insignificant whitespace and numbers
+// kept as written, so that reformatting a document does not change its fingerprint
+func canonicalJSON(doc string) ([]byte, error) {
+	decoder := json.NewDecoder(bytes.NewReader([]byte(doc)))
+	decoder.UseNumber()
+	var v interface{}
+	err := decoder.Decode(&v)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	err = encoder.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
+
+// fingerprintDocument hashes a JSON payload in canonical form and a PDF payload as is
+func fingerprintDocument(format string, doc string) (string, error) {
+	if format == "JSON" {
+		canonical, err := canonicalJSON(doc)
+		if err != nil {
+			return "", errors.New("Document is not valid JSON. " + err.Error())
+		}
+		return sha256Hex(canonical), nil
+	}
+	return sha256Hex([]byte(doc)), nil
+}
+
+// getFingerprints returns every fingerprint recorded for a contract document, oldest first
+func getFingerprints(stub shim.ChaincodeStubInterface, contractID string, docType string) ([]DocumentFingerprint, error) {
+	var fingerprints []DocumentFingerprint
+	recBytes, err := stub.GetState(fingerprintKey(contractID, docType))
+	if err != nil {
+		return nil, err
+	}
+	if recBytes == nil {
+		return fingerprints, nil
+	}
+	err = json.Unmarshal(recBytes, &fingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal fingerprints of %s for contract %s", docType, contractID)
+	}
+	return fingerprints, nil
+}
+
+// recordFingerprints stores the fingerprints of the JSON and PDF payloads of a submitted document.
+// Each submission of the same document gets the next version number.
+func recordFingerprints(stub shim.ChaincodeStubInterface, contractID string, docType string, docJSON string, docPDF string, submitter string, role string) error {
+	fingerprints, err := getFingerprints(stub, contractID, docType)
+	if err != nil {
+		return err
+	}
+	version := 1
+	if len(fingerprints) > 0 {
+		version = fingerprints[len(fingerprints)-1].Version + 1
+	}
+
+	timestamp := ""
+	ts, err := stub.GetTxTimestamp()
+	if err == nil && ts != nil {
+		timestamp = time.Unix(ts.Seconds, int64(ts.Nanos)).UTC().Format(time.RFC3339)
+	}
+	certHash := ""
+	cert, err := stub.GetCallerCertificate()
+	if err == nil && len(cert) > 0 {
+		certHash = sha256Hex(cert)
+	}
+
+	payloads := []struct{ format, doc string }{{"JSON", docJSON}, {"PDF", docPDF}}
+	for _, payload := range payloads {
+		if payload.doc == "" {
+			continue
+		}
+		hash, err := fingerprintDocument(payload.format, payload.doc)
+		if err != nil {
+			return err
+		}
+		fingerprints = append(fingerprints, DocumentFingerprint{
+			DocType:        docType,
+			Format:         payload.format,
+			Version:        version,
+			SHA256:         hash,
+			Submitter:      submitter,
+			SubmitterRole:  role,
+			CallerCertHash: certHash,
+			TxID:           stub.GetTxID(),
+			Timestamp:      timestamp,
+		})
+	}
+
+	fingerprintBytes, _ := json.Marshal(fingerprints)
+	return stub.PutState(fingerprintKey(contractID, docType), fingerprintBytes)
+}
+
+// verifyDocument tells whether a document matches the latest fingerprint recorded for it.
+// args: contractID, docType (LC, BL, INVOICE or PACKINGLIST), format (JSON or PDF), document
+func (t *TF) verifyDocument(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	contractID := args[0]
+	docType := args[1]
+	format := args[2]
+
+	if docType != "LC" && docType != "BL" && docType != "INVOICE" && docType != "PACKINGLIST" {
+		return nil, errors.New("Document type should be LC or BL or INVOICE or PACKINGLIST")
+	}
+	if format != "JSON" && format != "PDF" {
+		return nil, errors.New("Document format should be JSON or PDF")
+	}
+
+	hash, err := fingerprintDocument(format, args[3])
+	if err != nil {
+		return nil, err
+	}
+	fingerprints, err := getFingerprints(stub, contractID, docType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := struct {
+		Matches        bool
+		MatchesVersion int
+		SHA256         string
+		Fingerprint    *DocumentFingerprint
+	}{SHA256: hash}
+
+	// The latest submission of the format is the one in force; an older match is still reported
+	for i := len(fingerprints) - 1; i >= 0; i-- {
+		if fingerprints[i].Format != format {
+			continue
+		}
+		if result.Fingerprint == nil {
+			latest := fingerprints[i]
+			result.Fingerprint = &latest
+			result.Matches = latest.SHA256 == hash
+		}
+		if fingerprints[i].SHA256 == hash {
+			result.MatchesVersion = fingerprints[i].Version
+			break
+		}
+	}
+	if result.Fingerprint == nil {
+		return nil, errors.New("No " + format + " fingerprint recorded for " + docType + " of contract " + contractID)
+	}
+
+	return json.Marshal(result)
+}
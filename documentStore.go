@@ -0,0 +1,131 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// BlobStore keeps document binaries off the ledger. Blobs are addressed by their SHA-256 hash,
+// so every peer executing the same transaction stores the blob under the same URI.
+// The store must be shared by all peers and outlive them: a directory on one peer is neither.
+// Clients fetch the files from the store themselves, using the URI kept on the ledger.
+type BlobStore interface {
+	Put(hash string, data []byte) (string, error)
+}
+
+// blobStore is the store used for document PDFs. A deployment sets its store with SetBlobStore from an
+// init function in a file of its own; without one the PDFs stay on the ledger as they always did.
+var blobStore BlobStore
+
+// SetBlobStore sets the store document PDFs are kept in
+func SetBlobStore(store BlobStore) {
+	blobStore = store
+}
+
+// DocumentRef is kept in the DocPDF column in place of the document itself
+type DocumentRef struct {
+	SHA256    string
+	Size      int
+	MimeType  string
+	URI       string
+	Encrypted bool `json:"Encrypted,omitempty"`
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// storeDocument puts a document in the blob store and returns the reference to save on the ledger.
+// Without a blob store the document itself is returned, to be saved in place of the reference.
+// The blob is encrypted if the caller supplied the contract key; the hash is always of the plain document.
+// An empty document gives an empty reference.
+func storeDocument(stub shim.ChaincodeStubInterface, contractID string, docType string, doc string) (string, error) {
+	if doc == "" {
+		return "", nil
+	}
+	data := []byte(doc)
+	blob, encrypted, err := encryptBlob(stub, contractID, docType, data)
+	if err != nil {
+		return "", err
+	}
+	if blobStore == nil {
+		return string(blob), nil
+	}
+
+	var ref DocumentRef
+	ref.SHA256 = sha256Hex(data)
+	ref.Size = len(data)
+	ref.MimeType = http.DetectContentType(data)
+	ref.Encrypted = encrypted
+	uri, err := blobStore.Put(sha256Hex(blob), blob)
+	if err != nil {
+		return "", errors.New("Failed to store document. " + err.Error())
+	}
+	ref.URI = uri
+
+	refBytes, _ := json.Marshal(ref)
+	return string(refBytes), nil
+}
+
+// parseDocumentRef reads a DocPDF column. Documents submitted before off-chain storage still hold
+// the file itself; for those the reference is computed from the stored bytes and has no URI.
+func parseDocumentRef(docPDF []byte) *DocumentRef {
+	if len(docPDF) == 0 {
+		return nil
+	}
+	var ref DocumentRef
+	if json.Unmarshal(docPDF, &ref) == nil && ref.SHA256 != "" {
+		return &ref
+	}
+	return &DocumentRef{SHA256: sha256Hex(docPDF), Size: len(docPDF), MimeType: http.DetectContentType(docPDF)}
+}
+
+// verifyDocumentHash checks a retrieved file against the hash anchored on the ledger.
+// args: contractID, docType (LC, BL, INVOICE or PACKINGLIST), file contents
+func (t *TF) verifyDocumentHash(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	contractID := args[0]
+	docType := args[1]
+
+	var docPDF []byte
+	var err error
+	if docType == "LC" {
+		docPDF, err = t.lc.GetPDF(stub, []string{contractID})
+	} else if docType == "BL" {
+		docPDF, err = t.bl.GetPDF(stub, []string{contractID})
+	} else if docType == "INVOICE" {
+		docPDF, err = t.invoice.GetPDF(stub, []string{contractID})
+	} else if docType == "PACKINGLIST" {
+		docPDF, err = t.pl.GetPDF(stub, []string{contractID})
+	} else {
+		return nil, errors.New("Document type should be LC or BL or INVOICE or PACKINGLIST")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	ref := parseDocumentRef(docPDF)
+	if ref == nil {
+		return nil, errors.New("No document stored for " + docType + " of contract " + contractID)
+	}
+
+	result := struct {
+		Verified bool
+		SHA256   string
+		Expected DocumentRef
+	}{}
+	result.SHA256 = sha256Hex([]byte(args[2]))
+	result.Expected = *ref
+	result.Verified = result.SHA256 == ref.SHA256 && len(args[2]) == ref.Size
+
+	return json.Marshal(result)
+}
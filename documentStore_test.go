@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const localBlobScheme = "file://"
+
+// LocalBlobStore keeps blobs in a local directory. It is only fit for tests:
+// the directory belongs to one peer and is not replicated.
+type LocalBlobStore struct {
+	Dir string
+}
+
+func (s *LocalBlobStore) Put(hash string, data []byte) (string, error) {
+	err := os.MkdirAll(s.Dir, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(s.Dir, hash)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		err = ioutil.WriteFile(path, data, 0600)
+		if err != nil {
+			return "", err
+		}
+	}
+	return localBlobScheme + path, nil
+}
+
+func (s *LocalBlobStore) Get(uri string) ([]byte, error) {
+	if !strings.HasPrefix(uri, localBlobScheme) {
+		return nil, errors.New("Unsupported blob URI " + uri)
+	}
+	return ioutil.ReadFile(strings.TrimPrefix(uri, localBlobScheme))
+}
+
+func newTestBlobStore(t *testing.T) (*LocalBlobStore, func()) {
+	dir, err := ioutil.TempDir("", "blobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &LocalBlobStore{Dir: dir}, func() { os.RemoveAll(dir) }
+}
+
+func TestLocalBlobStoreRoundTrip(t *testing.T) {
+	store, cleanup := newTestBlobStore(t)
+	defer cleanup()
+
+	data := []byte("%PDF-1.4 bill of lading")
+	uri, err := store.Put(sha256Hex(data), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := store.Put(sha256Hex(data), data)
+	if err != nil || again != uri {
+		t.Fatalf("Put is not idempotent: %s != %s (%v)", again, uri, err)
+	}
+	got, err := store.Get(uri)
+	if err != nil || !bytes.Equal(got, data) {
+		t.Fatalf("Get returned %q (%v)", got, err)
+	}
+	if _, err := store.Get("s3://bucket/" + sha256Hex(data)); err == nil {
+		t.Fatal("Get accepted a URI of another store")
+	}
+}
+
+// callerStub is a stub whose caller supplied no metadata, hence no contract keys
+type callerStub struct {
+	shim.ChaincodeStubInterface
+}
+
+func (s *callerStub) GetCallerMetadata() ([]byte, error) {
+	return nil, nil
+}
+
+func TestStoreDocumentWithoutBlobStore(t *testing.T) {
+	saved := blobStore
+	defer SetBlobStore(saved)
+	SetBlobStore(nil)
+
+	ref, err := storeDocument(&callerStub{}, "C1", "BL", "")
+	if err != nil || ref != "" {
+		t.Fatalf("empty document gave %q (%v)", ref, err)
+	}
+	ref, err = storeDocument(&callerStub{}, "C1", "BL", "%PDF-1.4")
+	if err != nil || ref != "%PDF-1.4" {
+		t.Fatalf("document without a blob store gave %q (%v)", ref, err)
+	}
+}
+
+func TestStoreDocumentInBlobStore(t *testing.T) {
+	store, cleanup := newTestBlobStore(t)
+	defer cleanup()
+	saved := blobStore
+	defer SetBlobStore(saved)
+	SetBlobStore(store)
+
+	doc := "%PDF-1.4 invoice"
+	refJSON, err := storeDocument(&callerStub{}, "C1", "INVOICE", doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := parseDocumentRef([]byte(refJSON))
+	if ref.SHA256 != sha256Hex([]byte(doc)) || ref.URI == "" || ref.Encrypted {
+		t.Fatalf("reference %+v", ref)
+	}
+	got, err := store.Get(ref.URI)
+	if err != nil || string(got) != doc {
+		t.Fatalf("stored %q (%v)", got, err)
+	}
+}
+
+func TestParseDocumentRef(t *testing.T) {
+	if parseDocumentRef(nil) != nil {
+		t.Fatal("reference for an empty column")
+	}
+
+	legacy := []byte("%PDF-1.4 letter of credit")
+	ref := parseDocumentRef(legacy)
+	if ref.SHA256 != sha256Hex(legacy) || ref.Size != len(legacy) || ref.URI != "" {
+		t.Fatalf("legacy document gave %+v", ref)
+	}
+
+	stored := []byte(`{"SHA256":"abc","Size":3,"MimeType":"application/pdf","URI":"file:///blobs/abc"}`)
+	ref = parseDocumentRef(stored)
+	if ref.SHA256 != "abc" || ref.Size != 3 || ref.URI != "file:///blobs/abc" {
+		t.Fatalf("stored reference gave %+v", ref)
+	}
+}
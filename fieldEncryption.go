@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// ENCRYPTED_PREFIX marks a field value that is encrypted at rest: ENCRYPTED_PREFIX + base64(ciphertext)
+const ENCRYPTED_PREFIX = "ENC:"
+
+// Sensitive fields of each document. "List[].Field" names a field of every element of a list.
+var sensitiveLCFields = []string{"Tag32B", "Tag39A", "Tag50", "Tag59", "Tag57D"}
+var sensitiveInvoiceFields = []string{"PAYER", "PAYEE", "TOTAL_IN_WORDS", "TOTAL_IN_FIGURES", "Rows[].AMOUNT_CHARGED"}
+var sensitivePOFields = []string{"UnitPrice", "Amount", "LineItems[].UnitPrice", "LineItems[].Amount"}
+
+// callerKeys holds the per-contract keys supplied with a transaction
+type callerKeys struct {
+	Keys map[string]string
+}
+
+// contractKey returns the AES key the caller supplied for a contract, or nil if none was supplied.
+// Fabric 0.6 has no transient map; the caller metadata plays its part. The chaincode never puts a key
+// in the world state, but the metadata is recorded with the transaction in its block, so a deployment
+// that must keep the keys from block readers runs with confidentiality on, which encrypts the
+// transaction payload. Clients send {"Keys":{"<contractID>":"<base64 key>"}}.
+func contractKey(stub shim.ChaincodeStubInterface, contractID string) ([]byte, error) {
+	metadata, err := stub.GetCallerMetadata()
+	if err != nil || len(metadata) == 0 {
+		return nil, nil
+	}
+	var supplied callerKeys
+	// Metadata that is not a key set (e.g. a signature used for access control) carries no keys
+	if json.Unmarshal(metadata, &supplied) != nil || supplied.Keys[contractID] == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(supplied.Keys[contractID])
+	if err != nil {
+		return nil, errors.New("Key for contract " + contractID + " should be base64 encoded")
+	}
+	if len(key) != 16 && len(key) != 24 && len(key) != 32 {
+		return nil, errors.New("Key for contract " + contractID + " should be 16, 24 or 32 bytes")
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptValue seals a field with AES-GCM. Every peer has to write the same ciphertext, so the nonce is
+// derived from the transaction ID, the field and the plaintext instead of being random; a nonce is only
+// reused for the same plaintext. The contract and field are bound as additional data so a ciphertext
+// cannot be moved to another field.
+func encryptValue(stub shim.ChaincodeStubInterface, key []byte, field string, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	seed := sha256.Sum256(append([]byte(stub.GetTxID()+"~"+field+"~"), plaintext...))
+	nonce := seed[:gcm.NonceSize()]
+	sealed := gcm.Seal(nil, nonce, plaintext, []byte(field))
+	return ENCRYPTED_PREFIX + base64.StdEncoding.EncodeToString(append(nonce, sealed...)), nil
+}
+
+// decryptValue opens a field sealed by encryptValue
+func decryptValue(key []byte, field string, value string) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(value, ENCRYPTED_PREFIX))
+	if err != nil || len(data) < gcm.NonceSize() {
+		return nil, errors.New("Malformed encrypted field " + field)
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], []byte(field))
+	if err != nil {
+		return nil, errors.New("Failed to decrypt " + field + ". Wrong key?")
+	}
+	return plaintext, nil
+}
+
+// transformFields calls fn on every value of doc named by fields and replaces it with the result
+func transformFields(doc map[string]interface{}, fields []string, fn func(path string, value interface{}) (interface{}, error)) error {
+	for _, field := range fields {
+		parts := strings.SplitN(field, "[].", 2)
+		if len(parts) == 1 {
+			value, ok := doc[field]
+			if !ok || value == nil {
+				continue
+			}
+			newValue, err := fn(field, value)
+			if err != nil {
+				return err
+			}
+			doc[field] = newValue
+			continue
+		}
+		list, ok := doc[parts[0]].([]interface{})
+		if !ok {
+			continue
+		}
+		for i, element := range list {
+			item, ok := element.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			path := parts[0] + "[" + strconv.Itoa(i) + "]." + parts[1]
+			err := transformFields(item, []string{parts[1]}, func(_ string, value interface{}) (interface{}, error) {
+				return fn(path, value)
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func decodeDocument(doc []byte) (map[string]interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.UseNumber()
+	var fields map[string]interface{}
+	err := decoder.Decode(&fields)
+	return fields, err
+}
+
+// encryptJSONFields encrypts the sensitive fields of a document if the caller supplied the contract key.
+// Without a key the document is stored as is.
+func encryptJSONFields(stub shim.ChaincodeStubInterface, contractID string, doc []byte, fields []string) ([]byte, error) {
+	key, err := contractKey(stub, contractID)
+	if err != nil || key == nil || len(doc) == 0 {
+		return doc, err
+	}
+	fieldMap, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = transformFields(fieldMap, fields, func(path string, value interface{}) (interface{}, error) {
+		if s, ok := value.(string); ok && strings.HasPrefix(s, ENCRYPTED_PREFIX) {
+			return value, nil
+		}
+		plaintext, _ := json.Marshal(value)
+		return encryptValue(stub, key, contractID+"/"+path, plaintext)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fieldMap)
+}
+
+// decryptJSONFields decrypts the sensitive fields of a stored document if the caller supplied the contract key.
+// Without a key the encrypted values are returned.
+func decryptJSONFields(stub shim.ChaincodeStubInterface, contractID string, doc []byte, fields []string) ([]byte, error) {
+	if !bytes.Contains(doc, []byte(ENCRYPTED_PREFIX)) {
+		return doc, nil
+	}
+	key, err := contractKey(stub, contractID)
+	if err != nil || key == nil {
+		return doc, err
+	}
+	fieldMap, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	err = transformFields(fieldMap, fields, func(path string, value interface{}) (interface{}, error) {
+		s, ok := value.(string)
+		if !ok || !strings.HasPrefix(s, ENCRYPTED_PREFIX) {
+			return value, nil
+		}
+		plaintext, err := decryptValue(key, contractID+"/"+path, s)
+		if err != nil {
+			return nil, err
+		}
+		decoder := json.NewDecoder(bytes.NewReader(plaintext))
+		decoder.UseNumber()
+		var original interface{}
+		err = decoder.Decode(&original)
+		return original, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(fieldMap)
+}
+
+// encryptBlob encrypts a document binary with the contract key if the caller supplied one
+func encryptBlob(stub shim.ChaincodeStubInterface, contractID string, docType string, data []byte) ([]byte, bool, error) {
+	key, err := contractKey(stub, contractID)
+	if err != nil || key == nil {
+		return data, false, err
+	}
+	sealed, err := encryptValue(stub, key, contractID+"/"+docType, data)
+	if err != nil {
+		return nil, false, err
+	}
+	return []byte(sealed), true, nil
+}
+
+// isEncrypted tells whether a field value is stored encrypted
+func isEncrypted(value string) bool {
+	return strings.HasPrefix(value, ENCRYPTED_PREFIX)
+}
+
+// requireDecrypted fails when a document still holds encrypted fields, i.e. the key was not supplied
+func requireDecrypted(contractID string, doc []byte) error {
+	if bytes.Contains(doc, []byte("\""+ENCRYPTED_PREFIX)) {
+		return errors.New("Contract " + contractID + " holds encrypted data. Supply its key to proceed.")
+	}
+	return nil
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// FINANCING prefixes the financing of a presentation: FINANCING + UID
+const FINANCING = "FIN~"
+
+// Financing states
+const (
+	FINANCING_OFFERED  = "OFFERED"
+	FINANCING_DECLINED = "DECLINED"
+	FINANCING_ADVANCED = "ADVANCED"
+	FINANCING_REPAID   = "REPAID"
+)
+
+// Financing is the exporter bank discounting an accepted usance presentation before maturity
+type Financing struct {
+	ContractID    string
+	Financier     string
+	Currency      string
+	FaceAmount    float64
+	AnnualRate    float64
+	DayCountBasis int
+	MaturityDate  string
+	Days          int
+	Discount      float64
+	Advance       float64
+	Status        string
+	OfferedOn     string
+	AdvancedOn    string  `json:",omitempty"`
+	Repaid        float64 `json:",omitempty"`
+	RepaidOn      string  `json:",omitempty"`
+}
+
+// FinancingExposure is what a bank has advanced and not yet been repaid
+type FinancingExposure struct {
+	Financier  string
+	Exposure   map[string]float64
+	Financings []Financing
+}
+
+func getFinancing(stub shim.ChaincodeStubInterface, UID string) (*Financing, error) {
+	recBytes, err := stub.GetState(FINANCING + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + FINANCING + UID)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var financing Financing
+	err = json.Unmarshal(recBytes, &financing)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal financing of " + UID)
+	}
+	return &financing, nil
+}
+
+func putFinancing(stub shim.ChaincodeStubInterface, financing *Financing) error {
+	recBytes, _ := json.Marshal(financing)
+	return stub.PutState(FINANCING+financing.ContractID, recBytes)
+}
+
+// offerFinancing has the exporter bank offer to discount a usance presentation the importer bank has accepted to pay;
+// args: UID, annual discount rate in percent, optional day count basis (360|365)
+func (t *TF) offerFinancing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 3.")
+	}
+
+	UID := args[0]
+	existing, err := getFinancing(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && existing.Status != FINANCING_DECLINED {
+		return nil, errors.New("Financing of " + UID + " has already been " + existing.Status)
+	}
+	edStatus, err := t.bl.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(edStatus) != "ACCEPTED_BY_IB" {
+		return nil, errors.New("Only a presentation accepted by the importer bank can be financed")
+	}
+	lcStatus, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(lcStatus) == "PAYMENT_RECEIVED" || string(lcStatus) == "PAYMENT_DEFAULTED" {
+		return nil, errors.New("LC " + UID + " is " + string(lcStatus))
+	}
+
+	financing := Financing{ContractID: UID, DayCountBasis: 360, Status: FINANCING_OFFERED}
+	financing.AnnualRate, err = strconv.ParseFloat(args[1], 64)
+	if err != nil || financing.AnnualRate < 0 {
+		return nil, errors.New("Annual rate should be a percentage of zero or more")
+	}
+	if len(args) == 3 && args[2] != "" {
+		financing.DayCountBasis, err = strconv.Atoi(args[2])
+		if err != nil || (financing.DayCountBasis != 360 && financing.DayCountBasis != 365) {
+			return nil, errors.New("Day count basis should be 360 or 365")
+		}
+	}
+
+	// The face amount and maturity are those of the settlement, fixed when the importer bank accepted to pay
+	settlement, err := getSettlement(stub, "LC", UID)
+	if err != nil {
+		return nil, err
+	}
+	if settlement == nil {
+		return nil, errors.New("Only a presentation the importer bank has accepted to pay can be financed")
+	}
+	financing.Currency = settlement.Currency
+	financing.FaceAmount = settlement.Outstanding
+	maturity, err := time.Parse(time_format, settlement.DueDate)
+	if err != nil {
+		return nil, errors.New("Due date of " + UID + " is not a date")
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse(time_format, now.Format(time_format))
+	financing.Days = int(maturity.Sub(today).Hours() / 24)
+	if financing.Days <= 0 {
+		return nil, errors.New("Only a usance presentation that has not matured can be financed")
+	}
+	financing.MaturityDate = maturity.Format(time_format)
+	financing.OfferedOn = today.Format(time_format)
+	financing.Discount = math.Floor(financing.FaceAmount*financing.AnnualRate/100*float64(financing.Days)/float64(financing.DayCountBasis)*100+0.5) / 100
+	financing.Advance = financing.FaceAmount - financing.Discount
+
+	row, err := getContractRow(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	financing.Financier = row.Columns[6].GetString_()
+	return nil, putFinancing(stub, &financing)
+}
+
+// decideFinancing has the exporter take up or decline a financing offer; args: UID, ACCEPTED|DECLINED
+func (t *TF) decideFinancing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+	if args[1] != "ACCEPTED" && args[1] != FINANCING_DECLINED {
+		return nil, errors.New("Decision should be ACCEPTED or DECLINED")
+	}
+
+	financing, err := getFinancing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if financing == nil || financing.Status != FINANCING_OFFERED {
+		return nil, errors.New("No financing has been offered for " + args[0])
+	}
+	if args[1] == FINANCING_DECLINED {
+		financing.Status = FINANCING_DECLINED
+		return nil, putFinancing(stub, financing)
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	financing.Status = FINANCING_ADVANCED
+	financing.AdvancedOn = now.Format(time_format)
+	return nil, putFinancing(stub, financing)
+}
+
+// repayFinancing takes what is owed to the financier out of the proceeds of a contract and returns what is left
+func repayFinancing(stub shim.ChaincodeStubInterface, UID string, currency string, proceeds float64) (*ProceedsShare, error) {
+	financing, err := getFinancing(stub, UID)
+	if err != nil || financing == nil || financing.Status != FINANCING_ADVANCED || financing.Currency != currency {
+		return nil, err
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	financing.Repaid = math.Min(financing.FaceAmount, proceeds)
+	financing.RepaidOn = now.Format(time_format)
+	financing.Status = FINANCING_REPAID
+	err = putFinancing(stub, financing)
+	if err != nil {
+		return nil, err
+	}
+	return &ProceedsShare{Party: financing.Financier, Amount: financing.Repaid}, nil
+}
+
+// getFinancing returns the financing of a contract; args: UID
+func (t *TF) getFinancing(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	financing, err := getFinancing(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if financing == nil {
+		return nil, errors.New("No financing has been offered for " + args[0])
+	}
+	return json.Marshal(financing)
+}
+
+// getFinancingExposure returns the advances a bank has outstanding, in total per currency; args: bank name
+func (t *TF) getFinancingExposure(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	// '\x7f' sorts directly after the '~' that ends the prefix
+	iter, err := stub.RangeQueryState(FINANCING, FINANCING[:len(FINANCING)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query financings")
+	}
+	defer iter.Close()
+
+	exposure := FinancingExposure{Financier: args[0], Exposure: map[string]float64{}, Financings: make([]Financing, 0)}
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to read financings")
+		}
+		var financing Financing
+		err = json.Unmarshal(value, &financing)
+		if err != nil {
+			return nil, err
+		}
+		if financing.Financier != args[0] || financing.Status != FINANCING_ADVANCED {
+			continue
+		}
+		exposure.Exposure[financing.Currency] += financing.Advance
+		exposure.Financings = append(exposure.Financings, financing)
+	}
+	return json.Marshal(exposure)
+}
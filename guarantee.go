@@ -0,0 +1,455 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// GT_PREFIX prefixes the world state record of a guarantee or standby LC: GT_PREFIX + UID
+const GT_PREFIX = "GT_"
+
+// Forms of undertaking (MT760 field 22D)
+const (
+	DEMAND_GUARANTEE = "DGAR"
+	STANDBY_LC       = "STBY"
+)
+
+// Guarantee states
+const (
+	GT_ISSUED    = "ISSUED"
+	GT_CLAIMED   = "DEMAND_RECEIVED"
+	GT_EXHAUSTED = "EXHAUSTED"
+	GT_RELEASED  = "RELEASED"
+)
+
+// Demand states
+const (
+	DEMAND_PENDING  = "PENDING"
+	DEMAND_HONOURED = "HONOURED"
+	DEMAND_REJECTED = "REJECTED"
+)
+
+// defaultExaminationDays is the time the issuer has to honour or reject a demand when the undertaking does not say
+const defaultExaminationDays = 5
+
+// GT implements the guarantee and standby LC smart contract. The struct is the undertaking as issued in an MT760.
+type GT struct {
+	Form               string // 22D: DGAR or STBY
+	UndertakingNo      string // 20
+	ApplicableRules    string // 40C: e.g. URDG, ISPR, UCPR
+	Issuer             string // 52a
+	Applicant          string // 50
+	Beneficiary        string // 59
+	Currency           string // 32B
+	Amount             string // 32B
+	IssueDate          string // 30
+	ExpiryDate         string // 23B/31E
+	ClaimConditions    string // 77U: conditions a demand must meet, including the supporting statement required
+	ExaminationDays    int    `json:"ExaminationDays,omitempty"`
+	UnderlyingContract string `json:"UnderlyingContract,omitempty"`
+}
+
+// GTDemand is a demand for payment made by the beneficiary
+type GTDemand struct {
+	DemandNo  int
+	Amount    float64
+	Statement string
+	Date      string
+	Deadline  string
+	Status    string
+	Reason    string `json:"Reason,omitempty"`
+}
+
+// GTEvent is one entry of the history of a guarantee
+type GTEvent struct {
+	Event   string
+	Role    string
+	Amount  float64
+	Comment string `json:"Comment,omitempty"`
+	TxID    string
+	Date    string
+}
+
+// GTRecord is the on-ledger state of a guarantee
+type GTRecord struct {
+	ContractID      string
+	Undertaking     GT
+	Status          string
+	Available       float64
+	Demands         []GTDemand
+	History         []GTEvent
+	IssuerCert      []byte `json:"IssuerCert,omitempty"`
+	BeneficiaryCert []byte `json:"BeneficiaryCert,omitempty"`
+}
+
+func gtKey(UID string) string {
+	return GT_PREFIX + UID
+}
+
+// ValidateDoc () – checks an undertaking; args: undertakingJSON
+func (t *GT) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	var gt GT
+	err := json.Unmarshal([]byte(args[0]), &gt)
+	if err != nil {
+		return nil, errors.New("Undertaking should be a JSON object " + err.Error())
+	}
+
+	var problems []string
+	if gt.Form != DEMAND_GUARANTEE && gt.Form != STANDBY_LC {
+		problems = append(problems, "Form: should be DGAR or STBY")
+	}
+	if gt.UndertakingNo == "" {
+		problems = append(problems, "UndertakingNo: required field not provided")
+	}
+	if gt.Issuer == "" {
+		problems = append(problems, "Issuer: required field not provided")
+	}
+	if gt.Applicant == "" {
+		problems = append(problems, "Applicant: required field not provided")
+	}
+	if gt.Beneficiary == "" {
+		problems = append(problems, "Beneficiary: required field not provided")
+	}
+	if gt.ClaimConditions == "" {
+		problems = append(problems, "ClaimConditions: required field not provided")
+	}
+	if !isoCurrencyCodes[gt.Currency] {
+		problems = append(problems, "Currency: "+gt.Currency+" is not an ISO 4217 currency code")
+	}
+	if amount, err := parseDecimal(gt.Amount); err != nil || amount <= 0 {
+		problems = append(problems, "Amount: should be a positive number")
+	}
+	issueDate, err := time.Parse(time_format, gt.IssueDate)
+	if err != nil {
+		problems = append(problems, "IssueDate: incorrect date format. Expecting mm/dd/yyyy")
+	}
+	expiryDate, err2 := time.Parse(time_format, gt.ExpiryDate)
+	if err2 != nil {
+		problems = append(problems, "ExpiryDate: incorrect date format. Expecting mm/dd/yyyy")
+	} else if err == nil && !expiryDate.After(issueDate) {
+		problems = append(problems, "ExpiryDate: should be after IssueDate")
+	}
+	if gt.ExaminationDays < 0 {
+		problems = append(problems, "ExaminationDays: cannot be negative")
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.New("Validation failure: " + strings.Join(problems, "; "))
+	}
+	return []byte("SUCCESS"), nil
+}
+
+// getGTRecord reads a guarantee; nil if none exists
+func getGTRecord(stub shim.ChaincodeStubInterface, UID string) (*GTRecord, error) {
+	recBytes, err := stub.GetState(gtKey(UID))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get guarantee %s. Error %s", UID, err.Error())
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var record GTRecord
+	err = json.Unmarshal(recBytes, &record)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal guarantee %s", UID)
+	}
+	return &record, nil
+}
+
+// mustGetGTRecord reads a guarantee and fails if it does not exist
+func mustGetGTRecord(stub shim.ChaincodeStubInterface, UID string) (*GTRecord, error) {
+	record, err := getGTRecord(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("No guarantee exists for " + UID)
+	}
+	return record, nil
+}
+
+// putGTRecord stores a guarantee after adding an event to its history
+func putGTRecord(stub shim.ChaincodeStubInterface, record *GTRecord, event string, role string, amount float64, comment string, now time.Time) error {
+	record.History = append(record.History, GTEvent{Event: event, Role: role, Amount: amount, Comment: comment, TxID: stub.GetTxID(), Date: now.Format(time_format)})
+	recBytes, _ := json.Marshal(record)
+	return stub.PutState(gtKey(record.ContractID), recBytes)
+}
+
+// pendingDemand returns the demand waiting for the issuer's decision, if any
+func (r *GTRecord) pendingDemand() *GTDemand {
+	for i := range r.Demands {
+		if r.Demands[i].Status == DEMAND_PENDING {
+			return &r.Demands[i]
+		}
+	}
+	return nil
+}
+
+// SubmitDoc () – issues a guarantee; args: UID, undertakingJSON, optionally the issuer's and the beneficiary's certificates
+func (t *GT) SubmitDoc(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 && len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 or 4.")
+	}
+
+	UID := args[0]
+	_, err := t.ValidateDoc(stub, []string{args[1]})
+	if err != nil {
+		return nil, err
+	}
+	existing, err := getGTRecord(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		return nil, errors.New("Document already exists.")
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+
+	var record GTRecord
+	record.ContractID = UID
+	json.Unmarshal([]byte(args[1]), &record.Undertaking)
+	if record.Undertaking.ExaminationDays == 0 {
+		record.Undertaking.ExaminationDays = defaultExaminationDays
+	}
+	record.Available, _ = parseDecimal(record.Undertaking.Amount)
+	record.Status = GT_ISSUED
+	if len(args) == 4 {
+		record.IssuerCert = []byte(args[2])
+		record.BeneficiaryCert = []byte(args[3])
+	}
+
+	return nil, putGTRecord(stub, &record, GT_ISSUED, "Issuer", record.Available, "", now)
+}
+
+// Demand () – the beneficiary demands payment; args: UID, amount, supporting statement, role
+func (t *GT) Demand(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+	if args[3] != "Beneficiary" {
+		return nil, errors.New("Only the Beneficiary can demand payment under a guarantee")
+	}
+
+	record, err := mustGetGTRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record.Status != GT_ISSUED {
+		return nil, errors.New("Guarantee " + args[0] + " is " + record.Status + " and cannot be claimed")
+	}
+	amount, err := parseDecimal(args[1])
+	if err != nil || amount <= 0 {
+		return nil, errors.New("Demand amount should be a positive number")
+	}
+	if amount > record.Available+0.005 {
+		return nil, fmt.Errorf("Demand of %.2f exceeds the available amount %.2f", amount, record.Available)
+	}
+	statement := strings.TrimSpace(args[2])
+	if statement == "" {
+		return nil, errors.New("A demand must be supported by the statement required by the claim conditions: " + record.Undertaking.ClaimConditions)
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiry, _ := time.Parse(time_format, record.Undertaking.ExpiryDate)
+	if now.After(expiry.AddDate(0, 0, 1)) {
+		return nil, errors.New("Guarantee " + args[0] + " expired on " + record.Undertaking.ExpiryDate)
+	}
+
+	demand := GTDemand{
+		DemandNo:  len(record.Demands) + 1,
+		Amount:    amount,
+		Statement: statement,
+		Date:      now.Format(time_format),
+		Deadline:  now.AddDate(0, 0, record.Undertaking.ExaminationDays).Format(time_format),
+		Status:    DEMAND_PENDING,
+	}
+	record.Demands = append(record.Demands, demand)
+	record.Status = GT_CLAIMED
+
+	return nil, putGTRecord(stub, record, "DEMAND_"+strconv.Itoa(demand.DemandNo), "Beneficiary", amount, statement, now)
+}
+
+// DecideDemand () – the issuer honours or rejects the pending demand; args: UID, HONOURED or REJECTED, reason, role
+// A demand not rejected by its deadline can only be honoured.
+func (t *GT) DecideDemand(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+	if args[3] != "Issuer" {
+		return nil, errors.New("Only the Issuer can decide a demand")
+	}
+
+	decision := args[1]
+	if decision != DEMAND_HONOURED && decision != DEMAND_REJECTED {
+		return nil, errors.New("Decision should be HONOURED or REJECTED")
+	}
+	record, err := mustGetGTRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	demand := record.pendingDemand()
+	if demand == nil {
+		return nil, errors.New("Guarantee " + args[0] + " has no pending demand")
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if decision == DEMAND_REJECTED {
+		if args[2] == "" {
+			return nil, errors.New("A rejection must state the discrepancies")
+		}
+		deadline, _ := time.Parse(time_format, demand.Deadline)
+		if now.After(deadline.AddDate(0, 0, 1)) {
+			return nil, errors.New("The examination period ended on " + demand.Deadline + "; the demand can no longer be rejected")
+		}
+	}
+
+	demand.Status = decision
+	demand.Reason = args[2]
+	record.Status = GT_ISSUED
+	if decision == DEMAND_HONOURED {
+		record.Available -= demand.Amount
+		if record.Available < 0.005 {
+			record.Available = 0
+			record.Status = GT_EXHAUSTED
+		}
+	}
+
+	return nil, putGTRecord(stub, record, "DEMAND_"+strconv.Itoa(demand.DemandNo)+"_"+decision, "Issuer", demand.Amount, args[2], now)
+}
+
+// Reduce () – reduces the available amount, e.g. on partial completion of the underlying contract; args: UID, new amount, reason, role
+func (t *GT) Reduce(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+	if args[3] != "Issuer" {
+		return nil, errors.New("Only the Issuer can reduce a guarantee")
+	}
+
+	record, err := mustGetGTRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record.Status != GT_ISSUED {
+		return nil, errors.New("Guarantee " + args[0] + " is " + record.Status + " and cannot be reduced")
+	}
+	amount, err := parseDecimal(args[1])
+	if err != nil || amount < 0 {
+		return nil, errors.New("Reduced amount should be a number")
+	}
+	if amount >= record.Available {
+		return nil, fmt.Errorf("Reduced amount %.2f should be below the available amount %.2f", amount, record.Available)
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiry, _ := time.Parse(time_format, record.Undertaking.ExpiryDate)
+	if now.After(expiry.AddDate(0, 0, 1)) {
+		return nil, errors.New("Guarantee " + args[0] + " expired on " + record.Undertaking.ExpiryDate + " and cannot be reduced")
+	}
+	reduction := record.Available - amount
+	record.Available = amount
+	if amount == 0 {
+		record.Status = GT_EXHAUSTED
+	}
+	return nil, putGTRecord(stub, record, "REDUCED", "Issuer", reduction, args[2], now)
+}
+
+// Release () – ends the undertaking; args: UID, role, reason
+// The beneficiary can release it at any time, the issuer only once it has expired.
+func (t *GT) Release(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	who := args[1]
+	record, err := mustGetGTRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record.Status == GT_RELEASED {
+		return nil, errors.New("Guarantee " + args[0] + " is already released")
+	}
+	if record.pendingDemand() != nil {
+		return nil, errors.New("Guarantee " + args[0] + " has a pending demand")
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if who == "Issuer" {
+		expiry, _ := time.Parse(time_format, record.Undertaking.ExpiryDate)
+		if !now.After(expiry.AddDate(0, 0, 1)) && record.Status != GT_EXHAUSTED {
+			return nil, errors.New("The issuer can only release guarantee " + args[0] + " after it expires on " + record.Undertaking.ExpiryDate)
+		}
+	} else if who != "Beneficiary" {
+		return nil, errors.New("Only the Beneficiary or the Issuer can release a guarantee")
+	}
+
+	released := record.Available
+	record.Available = 0
+	record.Status = GT_RELEASED
+	return nil, putGTRecord(stub, record, GT_RELEASED, who, released, args[2], now)
+}
+
+// isCallerGuaranteeParty checks the caller against the certificate the guarantee was issued with for role,
+// Issuer or Beneficiary
+func (t *TF) isCallerGuaranteeParty(stub shim.ChaincodeStubInterface, UID string, role string) (bool, error) {
+	record, err := mustGetGTRecord(stub, UID)
+	if err != nil {
+		return false, err
+	}
+	if role == "Issuer" {
+		return t.isCaller(stub, record.IssuerCert)
+	}
+	if role == "Beneficiary" {
+		return t.isCaller(stub, record.BeneficiaryCert)
+	}
+	return false, nil
+}
+
+// GetJSON () – returns the guarantee with its demands and history
+func (t *GT) GetJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := getGTRecord(stub, args[0])
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
+
+// GetStatus () – returns the status of the guarantee
+func (t *GT) GetStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := getGTRecord(stub, args[0])
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return []byte(record.Status), nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// HS_CODE_TABLE prefixes the Harmonized System subheadings accepted on line items: HS_CODE_TABLE + 6 digits
+const HS_CODE_TABLE = "HSCODE~"
+
+// CONTROLLED_GOODS holds the configurable list of HS codes of dual-use and other controlled goods
+const CONTROLLED_GOODS = "CONTROLLED_GOODS"
+
+// LISTED_CONTROLLED_GOODS is the ListedType of screening hits raised for controlled goods
+const LISTED_CONTROLLED_GOODS = "CONTROLLED_GOODS"
+
+// an HS code is a 6 digit subheading, optionally followed by 2 or 4 digits of national tariff detail
+var hsCodeFormat = regexp.MustCompile(`^[0-9]{6}([0-9]{2}){0,2}$`)
+
+// HS codes quoted in the goods description of an LC, e.g. "HS 8414.80" or "HS CODE: 8414"
+var tag45AHSCodes = regexp.MustCompile(`(?i)\bHS(?:\s+CODE)?[\s:]*([0-9]{4}(?:\.?[0-9]{2}){0,3})\b`)
+
+// HSCode is a subheading of the code table
+type HSCode struct {
+	Code        string
+	Description string
+}
+
+// ControlledGoods is an entry of the controlled-goods list. Every HS code starting with HSPrefix is controlled.
+type ControlledGoods struct {
+	HSPrefix    string
+	Regime      string
+	Description string `json:",omitempty"`
+}
+
+// ControlledGoodsList is the controlled-goods list in force
+type ControlledGoodsList struct {
+	UpdatedOn string
+	Entries   []ControlledGoods
+}
+
+// hsLine is the HS code given on one line item of a document
+type hsLine struct {
+	Field string
+	Code  string
+}
+
+// normaliseHSCode drops the dots and spaces of a code written as 8414.80 or 8414 80
+func normaliseHSCode(code string) string {
+	return strings.NewReplacer(".", "", " ", "").Replace(strings.TrimSpace(code))
+}
+
+// loadHSCodes adds subheadings to the code table or replaces their descriptions; args: [{"Code":"","Description":""}], role
+func (t *TF) loadHSCodes(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+	if args[1] != "ComplianceOfficer" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+
+	var codes []HSCode
+	err := json.Unmarshal([]byte(args[0]), &codes)
+	if err != nil {
+		return nil, errors.New("HS codes should be a JSON array " + err.Error())
+	}
+	for i, code := range codes {
+		code.Code = normaliseHSCode(code.Code)
+		if len(code.Code) != 6 || !hsCodeFormat.MatchString(code.Code) {
+			return nil, fmt.Errorf("[%d].Code: %s is not a 6 digit HS subheading", i, codes[i].Code)
+		}
+		recBytes, _ := json.Marshal(code)
+		err = stub.PutState(HS_CODE_TABLE+code.Code, recBytes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return []byte(strconv.Itoa(len(codes))), nil
+}
+
+func getHSCode(stub shim.ChaincodeStubInterface, code string) (*HSCode, error) {
+	code = normaliseHSCode(code)
+	if len(code) < 6 {
+		return nil, nil
+	}
+	recBytes, err := stub.GetState(HS_CODE_TABLE + code[:6])
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + HS_CODE_TABLE + code[:6])
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var hsCode HSCode
+	err = json.Unmarshal(recBytes, &hsCode)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal HS code " + code[:6])
+	}
+	return &hsCode, nil
+}
+
+// hsCodeMessages checks the format of the HS codes given and that their subheadings are in the code table.
+// It returns one "\nField: message" line per failure.
+func hsCodeMessages(stub shim.ChaincodeStubInterface, lines []hsLine) (string, error) {
+	messages := ""
+	for _, line := range lines {
+		if !hsCodeFormat.MatchString(normaliseHSCode(line.Code)) {
+			messages += "\n" + line.Field + ": " + line.Code + " is not an HS code of 6, 8 or 10 digits"
+			continue
+		}
+		hsCode, err := getHSCode(stub, line.Code)
+		if err != nil {
+			return "", err
+		}
+		if hsCode == nil {
+			messages += "\n" + line.Field + ": " + line.Code + " is not in the HS code table"
+		}
+	}
+	return messages, nil
+}
+
+// setControlledGoods replaces the controlled-goods list; args: {"Entries":[{"HSPrefix":"","Regime":""}]}, role
+func (t *TF) setControlledGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+	if args[1] != "ComplianceOfficer" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+
+	var list ControlledGoodsList
+	err := json.Unmarshal([]byte(args[0]), &list)
+	if err != nil {
+		return nil, errors.New("Controlled goods list should be a JSON object " + err.Error())
+	}
+	for i := range list.Entries {
+		entry := &list.Entries[i]
+		entry.HSPrefix = normaliseHSCode(entry.HSPrefix)
+		if len(entry.HSPrefix) < 2 || len(entry.HSPrefix) > 10 || strings.Trim(entry.HSPrefix, "0123456789") != "" {
+			return nil, fmt.Errorf("Entries[%d].HSPrefix should be 2 to 10 digits", i)
+		}
+		if entry.Regime == "" {
+			return nil, fmt.Errorf("Entries[%d].Regime: required field not provided", i)
+		}
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	list.UpdatedOn = now.Format(time_format)
+
+	recBytes, _ := json.Marshal(list)
+	return nil, stub.PutState(CONTROLLED_GOODS, recBytes)
+}
+
+func getControlledGoodsList(stub shim.ChaincodeStubInterface) (*ControlledGoodsList, error) {
+	recBytes, err := stub.GetState(CONTROLLED_GOODS)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + CONTROLLED_GOODS)
+	}
+	list := ControlledGoodsList{Entries: make([]ControlledGoods, 0)}
+	if recBytes == nil {
+		return &list, nil
+	}
+	err = json.Unmarshal(recBytes, &list)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal the controlled goods list")
+	}
+	return &list, nil
+}
+
+// controlledGoodsHits flags the lines whose HS codes are on the controlled-goods list
+func controlledGoodsHits(stub shim.ChaincodeStubInterface, lines []hsLine) ([]ScreeningHit, error) {
+	hits := make([]ScreeningHit, 0)
+	if len(lines) == 0 {
+		return hits, nil
+	}
+	list, err := getControlledGoodsList(stub)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range lines {
+		code := normaliseHSCode(line.Code)
+		for _, entry := range list.Entries {
+			if strings.HasPrefix(code, entry.HSPrefix) {
+				listed := "HS " + entry.HSPrefix
+				if entry.Description != "" {
+					listed += " " + entry.Description
+				}
+				hits = append(hits, ScreeningHit{Field: line.Field, Value: line.Code, ListedName: listed, ListedType: LISTED_CONTROLLED_GOODS, Program: entry.Regime, Score: 1})
+			}
+		}
+	}
+	return hits, nil
+}
+
+func poHSLines(po *PurchaseOrder) []hsLine {
+	lines := make([]hsLine, 0)
+	for i, item := range po.LineItems {
+		if item.HSCode != "" {
+			lines = append(lines, hsLine{"LineItems[" + strconv.Itoa(i) + "].HSCode", item.HSCode})
+		}
+	}
+	return lines
+}
+
+func invoiceHSLines(invoice *Invoice) []hsLine {
+	lines := make([]hsLine, 0)
+	for i, row := range invoice.Rows {
+		if row.HS_CODE != "" {
+			lines = append(lines, hsLine{"Invoice.Rows[" + strconv.Itoa(i) + "].HS_CODE", row.HS_CODE})
+		}
+	}
+	return lines
+}
+
+func plHSLines(pl *PL) []hsLine {
+	lines := make([]hsLine, 0)
+	for i, row := range pl.Rows {
+		if row.HS_CODE != "" {
+			lines = append(lines, hsLine{"PackingList.Rows[" + strconv.Itoa(i) + "].HS_CODE", row.HS_CODE})
+		}
+	}
+	return lines
+}
+
+// subheadings are the distinct 6 digit subheadings of the lines
+func subheadings(lines []hsLine) []string {
+	set := make(map[string]bool)
+	for _, line := range lines {
+		code := normaliseHSCode(line.Code)
+		if len(code) >= 6 {
+			set[code[:6]] = true
+		}
+	}
+	codes := make([]string, 0, len(set))
+	for code := range set {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	return codes
+}
+
+// checkHSCodes validates the HS codes of the invoice and packing list presented under an LC and checks them
+// against each other, against the PO the LC was raised for and against the codes quoted in Tag45A
+func (t *TF) checkHSCodes(stub shim.ChaincodeStubInterface, UID string, lcJSON string, invoiceJSON string, packingListJSON string) error {
+	var invoice Invoice
+	var pl PL
+	json.Unmarshal([]byte(invoiceJSON), &invoice)
+	json.Unmarshal([]byte(packingListJSON), &pl)
+	invoiceLines := invoiceHSLines(&invoice)
+	plLines := plHSLines(&pl)
+
+	messages, err := hsCodeMessages(stub, append(append([]hsLine{}, invoiceLines...), plLines...))
+	if err != nil {
+		return err
+	}
+
+	invoiceCodes := subheadings(invoiceLines)
+	plCodes := subheadings(plLines)
+	if len(invoiceLines) > 0 && len(invoiceLines) != len(invoice.Rows) {
+		messages += "\nInvoice.Rows: HS_CODE must be given on every row or on none"
+	}
+	if len(plLines) > 0 && len(plLines) != len(pl.Rows) {
+		messages += "\nPackingList.Rows: HS_CODE must be given on every row or on none"
+	}
+	if len(invoiceCodes) > 0 && len(plCodes) > 0 && strings.Join(invoiceCodes, ",") != strings.Join(plCodes, ",") {
+		messages += "\nPackingList.Rows: HS codes " + strings.Join(plCodes, ", ") + " do not match the invoice HS codes " + strings.Join(invoiceCodes, ", ")
+	}
+
+	// goods ordered with HS codes must be invoiced under the same subheadings
+	poNumber, err := getLinkedPONumber(stub, UID)
+	if err != nil {
+		return err
+	}
+	if poNumber != "" {
+		po, err := getPO(stub, poNumber)
+		if err != nil {
+			return err
+		}
+		if po != nil && len(poHSLines(po)) > 0 {
+			ordered := toSet(subheadings(poHSLines(po)))
+			if len(invoiceLines) == 0 {
+				messages += "\nInvoice.Rows: HS_CODE is required, PO " + poNumber + " gives HS codes for its line items"
+			}
+			for _, line := range invoiceLines {
+				if code := normaliseHSCode(line.Code); len(code) >= 6 && !ordered[code[:6]] {
+					messages += "\n" + line.Field + ": " + line.Code + " is not an HS code of PO " + poNumber
+				}
+			}
+		}
+	}
+
+	// codes quoted in the LC goods description bind the invoice; a quoted heading covers its subheadings
+	var lc LC
+	json.Unmarshal([]byte(lcJSON), &lc)
+	quoted := make([]string, 0)
+	for _, match := range tag45AHSCodes.FindAllStringSubmatch(lc.Tag45A, -1) {
+		quoted = append(quoted, normaliseHSCode(match[1]))
+	}
+	if len(quoted) > 0 {
+		for _, line := range invoiceLines {
+			code := normaliseHSCode(line.Code)
+			covered := false
+			for _, q := range quoted {
+				if strings.HasPrefix(code, q) || strings.HasPrefix(q, code) {
+					covered = true
+					break
+				}
+			}
+			if !covered {
+				messages += "\n" + line.Field + ": " + line.Code + " is not among the HS codes of the LC goods description (Tag45A)"
+			}
+		}
+	}
+
+	if messages != "" {
+		return errors.New("HS codes are not consistent:" + messages)
+	}
+	return nil
+}
+
+// flagControlledGoods holds an LC contract whose presented invoice or packing list carries controlled goods
+func (t *TF) flagControlledGoods(stub shim.ChaincodeStubInterface, UID string, invoiceJSON string, packingListJSON string) error {
+	var invoice Invoice
+	var pl PL
+	json.Unmarshal([]byte(invoiceJSON), &invoice)
+	json.Unmarshal([]byte(packingListJSON), &pl)
+	hits, err := controlledGoodsHits(stub, append(invoiceHSLines(&invoice), plHSLines(&pl)...))
+	if err != nil || len(hits) == 0 {
+		return err
+	}
+	_, err = raiseScreeningHits(stub, "LC", UID, 0, hits)
+	return err
+}
+
+// getHSCode returns a subheading of the code table; args: HS code
+func (t *TF) getHSCode(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	hsCode, err := getHSCode(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if hsCode == nil {
+		return nil, errors.New(args[0] + " is not in the HS code table")
+	}
+	return json.Marshal(hsCode)
+}
+
+// getControlledGoods returns the controlled-goods list in force
+func (t *TF) getControlledGoods(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	list, err := getControlledGoodsList(stub)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(list)
+}
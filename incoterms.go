@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"regexp"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// INCOTERM_REPORT prefixes the Incoterms check of the export documents presented under an LC: INCOTERM_REPORT + contract ID
+const INCOTERM_REPORT = "INCOTERMS~"
+
+// Places an Incoterms rule can name
+const (
+	PLACE_OF_ORIGIN      = "ORIGIN"
+	PLACE_OF_LOADING     = "LOADING"
+	PLACE_OF_DISCHARGE   = "DISCHARGE"
+	PLACE_OF_DESTINATION = "DESTINATION"
+)
+
+// IncotermRule is what an Incoterms 2020 rule obliges the seller to arrange
+type IncotermRule struct {
+	Rule              string
+	SeaOnly           bool   // FAS, FOB, CFR and CIF are for sea and inland waterway transport only
+	FreightPrepaid    bool   // the seller contracts and pays for the main carriage
+	InsuranceRequired bool   // the seller insures the goods for the buyer (CIF, CIP)
+	NamedPlace        string // the place named after the rule
+}
+
+var incotermRules = map[string]IncotermRule{
+	"EXW": {"EXW", false, false, false, PLACE_OF_ORIGIN},
+	"FCA": {"FCA", false, false, false, PLACE_OF_LOADING},
+	"FAS": {"FAS", true, false, false, PLACE_OF_LOADING},
+	"FOB": {"FOB", true, false, false, PLACE_OF_LOADING},
+	"CFR": {"CFR", true, true, false, PLACE_OF_DISCHARGE},
+	"CIF": {"CIF", true, true, true, PLACE_OF_DISCHARGE},
+	"CPT": {"CPT", false, true, false, PLACE_OF_DESTINATION},
+	"CIP": {"CIP", false, true, true, PLACE_OF_DESTINATION},
+	"DAP": {"DAP", false, true, false, PLACE_OF_DESTINATION},
+	"DPU": {"DPU", false, true, false, PLACE_OF_DESTINATION},
+	"DDP": {"DDP", false, true, false, PLACE_OF_DESTINATION},
+}
+
+// an Incoterms rule quoted in the goods description of an LC, e.g. "CIF ROTTERDAM INCOTERMS 2020"; the named
+// place runs up to the end of the sentence or the word INCOTERMS
+var tag45AIncoterm = regexp.MustCompile(`\b(EXW|FCA|FAS|FOB|CFR|CIF|CPT|CIP|DAP|DPU|DDP)\b([^;,.\n]*)`)
+
+// modes of transport a sea-only rule cannot be used with
+var nonSeaTransport = regexp.MustCompile(`(?i)\b(AIR|ROAD|RAIL|TRUCK|LORRY)\b`)
+
+// a BL.PREPAID value saying the freight is not prepaid, e.g. "NOT PREPAID" or "FREIGHT NON-PREPAID"
+var freightNegation = regexp.MustCompile(`\b(NOT|NON|UNPAID)\b`)
+
+// IncotermReport lists the inconsistencies between the Incoterms rule declared for a contract and its documents
+type IncotermReport struct {
+	Rule       string
+	NamedPlace string
+	DeclaredIn string
+	Findings   []string
+	Result     string
+}
+
+// quotedIncoterm returns the Incoterms rule and named place quoted in an LC goods description
+func quotedIncoterm(tag45A string) (string, string) {
+	match := tag45AIncoterm.FindStringSubmatch(strings.ToUpper(tag45A))
+	if match == nil {
+		return "", ""
+	}
+	place := match[2]
+	if i := strings.Index(place, "INCOTERMS"); i >= 0 {
+		place = place[:i]
+	}
+	return match[1], strings.TrimSpace(place)
+}
+
+// placeCheck is a document field that must hold the place named after the rule
+type placeCheck struct {
+	Field  string
+	Places []string
+}
+
+// freightPrepaid reads BL.PREPAID. ok is false when it says neither prepaid nor collect. Collect and
+// negations are looked for first so that "NOT PREPAID" does not read as prepaid.
+func freightPrepaid(prepaid string) (bool, bool) {
+	value := strings.ToUpper(strings.TrimSpace(prepaid))
+	switch {
+	case value == "N" || value == "NO" || value == "FALSE" || strings.Contains(value, "COLLECT") || freightNegation.MatchString(value):
+		return false, true
+	case value == "Y" || value == "YES" || value == "TRUE" || strings.Contains(value, "PREPAID"):
+		return true, true
+	}
+	return false, false
+}
+
+// placeMatches compares a named place with a place on a document, allowing either to add a country or terminal
+func placeMatches(named string, place string) bool {
+	named, place = strings.ToUpper(strings.TrimSpace(named)), strings.ToUpper(strings.TrimSpace(place))
+	if named == "" || place == "" {
+		return false
+	}
+	return samePlace(named, place) || strings.Contains(named, place) || strings.Contains(place, named)
+}
+
+// checkIncoterms checks the LC, the PO it was raised for and the export documents against the Incoterms rule
+// declared for them. bl and pl may be nil; the insurance document is only required once presented is true.
+func checkIncoterms(lc *LC, po *PurchaseOrder, bl *BL, pl *PL, insuranceCompany string, presented bool) IncotermReport {
+	report := IncotermReport{Findings: make([]string, 0)}
+
+	// the PO terms of trade are the declared rule, else the packing list delivery terms, else the LC
+	quoted, quotedPlace := "", ""
+	if lc != nil {
+		quoted, quotedPlace = quotedIncoterm(lc.Tag45A)
+	}
+	if po != nil && po.TermsofTrade != "" {
+		report.Rule, report.NamedPlace = parseIncoterm(po.TermsofTrade)
+		report.DeclaredIn = "PO.TermsofTrade"
+	}
+	if report.Rule == "" && pl != nil && pl.DELIVERY_TERMS != "" {
+		report.Rule, report.NamedPlace = parseIncoterm(pl.DELIVERY_TERMS)
+		report.DeclaredIn = "PackingList.DELIVERY_TERMS"
+	}
+	if report.Rule == "" && quoted != "" {
+		report.Rule, report.NamedPlace = quoted, quotedPlace
+		report.DeclaredIn = "LC.Tag45A"
+	}
+	if report.Rule == "" {
+		report.Result = "Success: No Incoterms rule declared"
+		return report
+	}
+	rule := incotermRules[report.Rule]
+	finding := func(message string) {
+		report.Findings = append(report.Findings, message)
+	}
+
+	// every document quoting a rule must quote the declared one
+	if pl != nil && pl.DELIVERY_TERMS != "" {
+		plRule, plPlace := parseIncoterm(pl.DELIVERY_TERMS)
+		if plRule == "" {
+			finding("PackingList.DELIVERY_TERMS: " + pl.DELIVERY_TERMS + " does not start with an Incoterms 2020 rule")
+		} else if plRule != rule.Rule {
+			finding("PackingList.DELIVERY_TERMS: " + plRule + " does not match " + rule.Rule + " declared in " + report.DeclaredIn)
+		} else if report.NamedPlace != "" && plPlace != "" && !placeMatches(report.NamedPlace, plPlace) {
+			finding("PackingList.DELIVERY_TERMS: named place " + plPlace + " does not match " + report.NamedPlace)
+		}
+	}
+	if quoted != "" && quoted != rule.Rule {
+		finding("LC.Tag45A: " + quoted + " does not match " + rule.Rule + " declared in " + report.DeclaredIn)
+	}
+
+	// freight
+	if bl != nil && bl.PREPAID != "" {
+		prepaid, ok := freightPrepaid(bl.PREPAID)
+		if !ok {
+			finding("BL.PREPAID: " + bl.PREPAID + " says neither freight prepaid nor freight collect")
+		} else if rule.FreightPrepaid && !prepaid {
+			finding("BL.PREPAID: " + rule.Rule + " requires freight prepaid, the BL shows freight collect")
+		} else if !rule.FreightPrepaid && prepaid {
+			finding("BL.PREPAID: " + rule.Rule + " requires freight collect, the BL shows freight prepaid")
+		}
+	}
+
+	// insurance
+	if rule.InsuranceRequired {
+		if presented && strings.TrimSpace(insuranceCompany) == "" {
+			finding("InsuranceCompany: " + rule.Rule + " requires an insurance document, none was presented")
+		}
+		if lc != nil && lc.Tag46A != "" && !strings.Contains(strings.ToUpper(lc.Tag46A), "INSURANCE") {
+			finding("LC.Tag46A: " + rule.Rule + " requires an insurance document, the LC does not call for one")
+		}
+	}
+
+	// mode of transport
+	if rule.SeaOnly && pl != nil && nonSeaTransport.MatchString(pl.METHOD_OF_LOADING) {
+		finding("PackingList.METHOD_OF_LOADING: " + rule.Rule + " is for sea and inland waterway transport only, not " + pl.METHOD_OF_LOADING)
+	}
+
+	// named place: the first place of each check is the one the field holds, the others are also accepted
+	if report.NamedPlace != "" {
+		checks := make([]placeCheck, 0)
+		switch rule.NamedPlace {
+		case PLACE_OF_ORIGIN:
+			if bl != nil {
+				checks = append(checks, placeCheck{"BL.PLACE_OF_RECEIPT", []string{bl.PLACE_OF_RECEIPT}})
+			}
+			if lc != nil {
+				checks = append(checks, placeCheck{"LC.Tag44A", []string{lc.Tag44A}})
+			}
+		case PLACE_OF_LOADING:
+			if bl != nil {
+				checks = append(checks, placeCheck{"BL.PORT_OF_LOADING", []string{bl.PORT_OF_LOADING, bl.PLACE_OF_RECEIPT}})
+			}
+			if lc != nil {
+				checks = append(checks, placeCheck{"LC.Tag44E", []string{lc.Tag44E, lc.Tag44A}})
+			}
+		case PLACE_OF_DISCHARGE:
+			if bl != nil {
+				checks = append(checks, placeCheck{"BL.PORT_OF_DISCHARGE", []string{bl.PORT_OF_DISCHARGE}})
+			}
+			if lc != nil {
+				checks = append(checks, placeCheck{"LC.Tag44F", []string{lc.Tag44F}})
+			}
+		case PLACE_OF_DESTINATION:
+			if bl != nil {
+				checks = append(checks, placeCheck{"BL.PLACE_OF_DELIVERY", []string{bl.PLACE_OF_DELIVERY, bl.PORT_OF_DISCHARGE}})
+			}
+			if lc != nil {
+				checks = append(checks, placeCheck{"LC.Tag44B", []string{lc.Tag44B, lc.Tag44F}})
+			}
+		}
+		for _, check := range checks {
+			if strings.TrimSpace(check.Places[0]) == "" {
+				continue
+			}
+			matched := false
+			for _, place := range check.Places {
+				if placeMatches(report.NamedPlace, place) {
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				finding(check.Field + ": " + check.Places[0] + " is not the place named in " + rule.Rule + " " + report.NamedPlace)
+			}
+		}
+	}
+
+	if len(report.Findings) == 0 {
+		report.Result = "Success: Documents are consistent with " + strings.TrimSpace(rule.Rule+" "+report.NamedPlace)
+	} else {
+		report.Result = "Error: Documents are not consistent with " + strings.TrimSpace(rule.Rule+" "+report.NamedPlace)
+	}
+	return report
+}
+
+// incotermReport checks the documents of an LC contract against its Incoterms rule, taking the PO the LC was
+// raised for from the ledger
+func (t *TF) incotermReport(stub shim.ChaincodeStubInterface, UID string, lcJSON string, BLJSON string, packingListJSON string, insuranceCompany string, presented bool) (IncotermReport, error) {
+	var lc LC
+	var bl, pl = new(BL), new(PL)
+	json.Unmarshal([]byte(lcJSON), &lc)
+	if BLJSON == "" || json.Unmarshal([]byte(BLJSON), bl) != nil {
+		bl = nil
+	}
+	if packingListJSON == "" || json.Unmarshal([]byte(packingListJSON), pl) != nil {
+		pl = nil
+	}
+
+	poNumber, err := getLinkedPONumber(stub, UID)
+	if err != nil {
+		return IncotermReport{}, err
+	}
+	var po *PurchaseOrder
+	if poNumber != "" {
+		po, err = getPO(stub, poNumber)
+		if err != nil {
+			return IncotermReport{}, err
+		}
+	}
+	return checkIncoterms(&lc, po, bl, pl, insuranceCompany, presented), nil
+}
+
+// recordIncotermReport keeps the Incoterms check of the export documents presented under an LC for the examining banks
+func (t *TF) recordIncotermReport(stub shim.ChaincodeStubInterface, UID string, lcJSON string, BLJSON string, packingListJSON string, insuranceCompany string) error {
+	report, err := t.incotermReport(stub, UID, lcJSON, BLJSON, packingListJSON, insuranceCompany, true)
+	if err != nil {
+		return err
+	}
+	recBytes, _ := json.Marshal(report)
+	return stub.PutState(INCOTERM_REPORT+UID, recBytes)
+}
+
+// withIncotermFindings adds the Incoterms check to the output of a document validation
+func withIncotermFindings(res []byte, report IncotermReport) []byte {
+	var resultMap map[string]string
+	if json.Unmarshal(res, &resultMap) != nil || resultMap == nil {
+		return res
+	}
+	resultMap["incoterms"] = report.Result
+	if len(report.Findings) > 0 {
+		resultMap["incoterms"] += ": " + strings.Join(report.Findings, "; ")
+	}
+	out, _ := json.Marshal(resultMap)
+	return out
+}
+
+// getIncotermReport returns the Incoterms check of the export documents presented under an LC; args: contract ID
+func (t *TF) getIncotermReport(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	recBytes, err := stub.GetState(INCOTERM_REPORT + args[0])
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + INCOTERM_REPORT + args[0])
+	}
+	if recBytes == nil {
+		return nil, errors.New("No export documents have been presented under " + args[0])
+	}
+	return recBytes, nil
+}
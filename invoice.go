@@ -40,6 +40,7 @@ type invoiceRow struct {
 	ITEM           int
 	AMOUNT_CHARGED int
 	REMARKS        string
+	HS_CODE        string
 }
 
 //Init initializes the document smart contract
@@ -130,7 +131,7 @@ func (t *Invoice) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) (
 		return []byte("Error: Required field not provided."), nil
 	} else if invoiceDataStruct.DUE_DATE == "" {
 		return []byte("Error: Required field not provided."), nil
-	} else if invoiceDataStruct.LC_NUMBER == "" {
+	} else if invoiceDataStruct.LC_NUMBER == "" && len(lcJSON) != 0 {
 		return []byte("Error: Required field not provided."), nil
 	} else if invoiceDataStruct.PAYEE == "" {
 		return []byte("Error: Required field not provided."), nil
@@ -144,6 +145,12 @@ func (t *Invoice) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) (
 		return []byte("Error: Required field not provided."), nil
 	}
 
+	// Documents presented under a collection have no LC to be checked against
+	if len(lcJSON) == 0 {
+		resultMap["result"] = "Success: All validation checks passed"
+		return json.Marshal(resultMap)
+	}
+
 	var lcStruct LC
 	err = json.Unmarshal(lcJSON, &lcStruct)
 	if err != nil {
@@ -355,6 +362,11 @@ func (t *Invoice) SubmitDoc(stub shim.ChaincodeStubInterface, args []string) ([]
 		return nil, err
 	}
 
+	docJSON, err = encryptJSONFields(stub, UID, docJSON, sensitiveInvoiceFields)
+	if err != nil {
+		return nil, err
+	}
+
 	// Insert a row
 	ok, err := stub.InsertRow("invoiceTable", shim.Row{
 		Columns: []*shim.Column{
@@ -453,7 +465,7 @@ func (t *Invoice) UpdateStatus(stub shim.ChaincodeStubInterface, args []string)
 
 }
 
-// GetJSON () – returns as JSON a single document w.r.t. the UID
+// GetJSON () – returns as JSON a single document w.r.t. the UID, decrypted if the caller supplied the contract key
 func (t *Invoice) GetJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	if len(args) != 1 {
@@ -479,7 +491,7 @@ func (t *Invoice) GetJSON(stub shim.ChaincodeStubInterface, args []string) ([]by
 		return nil, nil
 	}
 
-	return row.Columns[2].GetBytes(), nil
+	return decryptJSONFields(stub, UID, row.Columns[2].GetBytes(), sensitiveInvoiceFields)
 
 }
 
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// LATE_INTEREST prefixes the late payment interest terms of a contract: LATE_INTEREST + UID
+const LATE_INTEREST = "LATEINT~"
+
+// DEFAULT prefixes the default record of a contract: DEFAULT + UID
+const DEFAULT = "DEFAULT~"
+
+// Default record states
+const (
+	DEFAULT_OPEN        = "OPEN"
+	DEFAULT_SETTLED     = "SETTLED"
+	DEFAULT_WRITTEN_OFF = "WRITTEN_OFF"
+)
+
+// draftDays reads the tenor of usance drafts in Tag42C, e.g. "60 DAYS AFTER SIGHT"
+var draftDays = regexp.MustCompile(`(?i)(\d+)\s*DAYS`)
+
+// LateInterestTerms is the interest charged on amounts paid after their due date
+type LateInterestTerms struct {
+	AnnualRate    float64 // percent per year
+	DayCountBasis int     // 360 or 365
+	GraceDays     int
+}
+
+// AmountDue is the principal outstanding on a contract with the interest accrued at a date
+type AmountDue struct {
+	ContractID      string
+	Currency        string
+	DueDate         string
+	AsOf            string
+	DaysLate        int
+	Principal       float64
+	AnnualRate      float64
+	AccruedInterest float64
+	Total           float64
+}
+
+// DefaultRecord is the claim raised when a contract is not paid
+type DefaultRecord struct {
+	ContractID      string
+	DefaultDate     string
+	Principal       float64
+	AccruedInterest float64
+	ClaimAmount     float64
+	Status          string
+	WrittenOff      float64
+	Reason          string
+	Recovery        Settlement // payments recovered against the claim
+}
+
+type byValueDate []Payment
+
+func (p byValueDate) Len() int      { return len(p) }
+func (p byValueDate) Swap(i, j int) { p[i], p[j] = p[j], p[i] }
+func (p byValueDate) Less(i, j int) bool {
+	a, _ := time.Parse(time_format, p[i].ValueDate)
+	b, _ := time.Parse(time_format, p[j].ValueDate)
+	return a.Before(b)
+}
+
+func getLateInterestTerms(stub shim.ChaincodeStubInterface, UID string) (*LateInterestTerms, error) {
+	recBytes, err := stub.GetState(LATE_INTEREST + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + LATE_INTEREST + UID)
+	}
+	terms := LateInterestTerms{DayCountBasis: 360}
+	if recBytes == nil {
+		return &terms, nil
+	}
+	err = json.Unmarshal(recBytes, &terms)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal late interest terms of " + UID)
+	}
+	return &terms, nil
+}
+
+// setLateInterest sets the late payment interest of a contract; args: UID, annual rate in percent, optional day count basis (360|365), optional grace days.
+// The terms cannot change once the payment is overdue, as that would rewrite the interest already accrued.
+func (t *TF) setLateInterest(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) < 2 || len(args) > 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2 to 4.")
+	}
+
+	_, err := getContractRow(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	defaulted, err := getDefaultRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if defaulted != nil {
+		return nil, errors.New("Contract " + args[0] + " has defaulted, its claim can no longer change")
+	}
+	settlement, err := getSettlement(stub, "LC", args[0])
+	if err != nil {
+		return nil, err
+	}
+	if settlement != nil {
+		now, err := txDate(stub)
+		if err != nil {
+			return nil, err
+		}
+		due, err := time.Parse(time_format, settlement.DueDate)
+		if err == nil && now.After(due) {
+			return nil, errors.New("Payment of " + args[0] + " has been overdue since " + settlement.DueDate + ", its late interest terms can no longer change")
+		}
+	}
+
+	terms := LateInterestTerms{DayCountBasis: 360}
+	terms.AnnualRate, err = strconv.ParseFloat(args[1], 64)
+	if err != nil || terms.AnnualRate < 0 {
+		return nil, errors.New("Annual rate should be a percentage of zero or more")
+	}
+	if len(args) > 2 && args[2] != "" {
+		terms.DayCountBasis, err = strconv.Atoi(args[2])
+		if err != nil || (terms.DayCountBasis != 360 && terms.DayCountBasis != 365) {
+			return nil, errors.New("Day count basis should be 360 or 365")
+		}
+	}
+	if len(args) > 3 && args[3] != "" {
+		terms.GraceDays, err = strconv.Atoi(args[3])
+		if err != nil || terms.GraceDays < 0 {
+			return nil, errors.New("Grace days should be a whole number of zero or more")
+		}
+	}
+
+	recBytes, _ := json.Marshal(terms)
+	return nil, stub.PutState(LATE_INTEREST+args[0], recBytes)
+}
+
+// lcDueDate is the transaction date for sight drafts, or that date plus the tenor given in Tag42C
+func (t *TF) lcDueDate(stub shim.ChaincodeStubInterface, UID string) (time.Time, error) {
+	now, err := txDate(stub)
+	if err != nil {
+		return now, err
+	}
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return now, err
+	}
+	var lc LC
+	err = json.Unmarshal(lcJSON, &lc)
+	if err != nil {
+		return now, err
+	}
+	match := draftDays.FindStringSubmatch(lc.Tag42C)
+	if match == nil {
+		return now, nil
+	}
+	days, _ := strconv.Atoi(match[1])
+	return now.AddDate(0, 0, days), nil
+}
+
+// amountDueAt works out the principal left and the interest accrued on it at a date.
+// Interest runs from the end of the grace period on the balance left after each payment.
+func amountDueAt(settlement *Settlement, terms *LateInterestTerms, asOf time.Time) (*AmountDue, error) {
+	due, err := time.Parse(time_format, settlement.DueDate)
+	if err != nil {
+		return nil, errors.New("Due date of " + settlement.ContractID + " is not a date")
+	}
+	// interest accrues in whole days
+	asOf, _ = time.Parse(time_format, asOf.Format(time_format))
+	amountDue := AmountDue{ContractID: settlement.ContractID, Currency: settlement.Currency, DueDate: settlement.DueDate, AsOf: asOf.Format(time_format), AnnualRate: terms.AnnualRate}
+	if asOf.After(due) {
+		amountDue.DaysLate = int(asOf.Sub(due).Hours() / 24)
+	}
+
+	payments := make([]Payment, len(settlement.Payments))
+	copy(payments, settlement.Payments)
+	sort.Sort(byValueDate(payments))
+
+	start := due.AddDate(0, 0, terms.GraceDays)
+	accrue := func(balance float64, from time.Time, to time.Time) {
+		if from.Before(start) {
+			from = start
+		}
+		if to.After(from) && terms.DayCountBasis > 0 {
+			days := to.Sub(from).Hours() / 24
+			amountDue.AccruedInterest += balance * terms.AnnualRate / 100 * days / float64(terms.DayCountBasis)
+		}
+	}
+
+	balance := settlement.AmountDue
+	cursor := start
+	for _, payment := range payments {
+		valueDate, _ := time.Parse(time_format, payment.ValueDate)
+		if valueDate.After(asOf) {
+			break
+		}
+		accrue(balance, cursor, valueDate)
+		if valueDate.After(cursor) {
+			cursor = valueDate
+		}
+		balance -= payment.Amount
+	}
+	accrue(balance, cursor, asOf)
+
+	if balance < 0.005 {
+		balance = 0
+	}
+	amountDue.Principal = math.Floor(balance*100+0.5) / 100
+	amountDue.AccruedInterest = math.Floor(amountDue.AccruedInterest*100+0.5) / 100
+	amountDue.Total = amountDue.Principal + amountDue.AccruedInterest
+	return &amountDue, nil
+}
+
+// getAmountDue returns the principal and accrued late interest on a contract; args: UID, optional date mm/dd/yyyy
+func (t *TF) getAmountDue(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2.")
+	}
+
+	settlement, err := getSettlement(stub, "LC", args[0])
+	if err != nil {
+		return nil, err
+	}
+	if settlement == nil {
+		return nil, errors.New("No payment is due on " + args[0])
+	}
+	terms, err := getLateInterestTerms(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var asOf time.Time
+	if len(args) == 2 {
+		asOf, err = time.Parse(time_format, args[1])
+		if err != nil {
+			return nil, errors.New("Incorrect date format. Expecting mm/dd/yyyy")
+		}
+	} else {
+		asOf, err = txDate(stub)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	amountDue, err := amountDueAt(settlement, terms, asOf)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amountDue)
+}
+
+func getDefaultRecord(stub shim.ChaincodeStubInterface, UID string) (*DefaultRecord, error) {
+	recBytes, err := stub.GetState(DEFAULT + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + DEFAULT + UID)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var record DefaultRecord
+	err = json.Unmarshal(recBytes, &record)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal default record of " + UID)
+	}
+	return &record, nil
+}
+
+func putDefaultRecord(stub shim.ChaincodeStubInterface, record *DefaultRecord) error {
+	recBytes, _ := json.Marshal(record)
+	return stub.PutState(DEFAULT+record.ContractID, recBytes)
+}
+
+// recordDefault raises a claim for the principal and the interest accrued up to the default
+func (t *TF) recordDefault(stub shim.ChaincodeStubInterface, UID string, reason string) error {
+	settlement, err := t.openLCSettlement(stub, UID)
+	if err != nil {
+		return err
+	}
+	terms, err := getLateInterestTerms(stub, UID)
+	if err != nil {
+		return err
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	// a payment is only in default once its due date and the grace days have passed
+	due, err := time.Parse(time_format, settlement.DueDate)
+	if err != nil {
+		return errors.New("Due date of " + UID + " is not a date")
+	}
+	lastDay := due.AddDate(0, 0, terms.GraceDays)
+	today, _ := time.Parse(time_format, now.Format(time_format))
+	if !today.After(lastDay) {
+		return errors.New("Payment of " + UID + " cannot be defaulted on before " + lastDay.AddDate(0, 0, 1).Format(time_format))
+	}
+	amountDue, err := amountDueAt(settlement, terms, now)
+	if err != nil {
+		return err
+	}
+
+	record := DefaultRecord{
+		ContractID:      UID,
+		DefaultDate:     amountDue.AsOf,
+		Principal:       amountDue.Principal,
+		AccruedInterest: amountDue.AccruedInterest,
+		ClaimAmount:     amountDue.Total,
+		Status:          DEFAULT_OPEN,
+		Reason:          reason,
+		Recovery: Settlement{
+			ContractID:   UID,
+			ContractType: settlement.ContractType,
+			Currency:     settlement.Currency,
+			AmountDue:    amountDue.Total,
+			Outstanding:  amountDue.Total,
+			DueDate:      amountDue.AsOf,
+			Status:       SETTLEMENT_OPEN,
+			Payments:     make([]Payment, 0),
+		},
+	}
+	err = putDefaultRecord(stub, &record)
+	if err != nil {
+		return err
+	}
+	// a confirmed LC must still be paid, by the confirming bank
+	return callConfirmation(stub, UID, amountDue.Principal, amountDue.AsOf)
+}
+
+func openDefaultRecord(stub shim.ChaincodeStubInterface, UID string) (*DefaultRecord, error) {
+	record, err := getDefaultRecord(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("Contract " + UID + " has not defaulted")
+	}
+	if record.Status != DEFAULT_OPEN {
+		return nil, errors.New("Default claim on " + UID + " is already " + record.Status)
+	}
+	return record, nil
+}
+
+// settleDefault books a recovery against a default claim; args: UID, payment JSON
+func (t *TF) settleDefault(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+
+	record, err := openDefaultRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	payment, err := parsePayment(args[1])
+	if err != nil {
+		return nil, err
+	}
+	err = record.Recovery.addPayment(stub, *payment)
+	if err != nil {
+		return nil, err
+	}
+	if record.Recovery.Status == SETTLEMENT_SETTLED {
+		record.Status = DEFAULT_SETTLED
+		err = releaseExposure(stub, args[0], "DEFAULT_SETTLED")
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, putDefaultRecord(stub, record)
+}
+
+// writeOffDefault writes off what is left of a default claim; args: UID, reason
+func (t *TF) writeOffDefault(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+
+	record, err := openDefaultRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	record.Status = DEFAULT_WRITTEN_OFF
+	record.WrittenOff = record.Recovery.Outstanding
+	if args[1] != "" {
+		record.Reason = args[1]
+	}
+	err = releaseExposure(stub, args[0], DEFAULT_WRITTEN_OFF)
+	if err != nil {
+		return nil, err
+	}
+	return nil, putDefaultRecord(stub, record)
+}
+
+// getDefault returns the default claim on a contract; args: UID
+func (t *TF) getDefault(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := getDefaultRecord(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("Contract " + args[0] + " has not defaulted")
+	}
+	return json.Marshal(record)
+}
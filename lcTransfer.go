@@ -0,0 +1,407 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// LC_TRANSFER_PARENT links a transferred credit to the credit it was transferred from: LC_TRANSFER_PARENT + child UID
+const LC_TRANSFER_PARENT = "LCT_PARENT_"
+
+// LC_TRANSFERS lists the credits transferred from an LC: LC_TRANSFERS + parent UID
+const LC_TRANSFERS = "LCT_CHILDREN_"
+
+// LCTransferRequest holds the terms of a transfer under UCP 600 article 38. Tag32B, Tag44C and Tag31D
+// may be reduced or brought forward; anything left empty is taken from the original credit.
+type LCTransferRequest struct {
+	SecondBeneficiary     string
+	SecondBeneficiaryBank string
+	Applicant             string
+	Tag32B                string
+	Tag44C                string
+	Tag31D                string
+	Tag48                 string
+}
+
+// LCTransfer describes a credit transferred from an LC
+type LCTransfer struct {
+	ContractID        string
+	SecondBeneficiary string
+	Tag32B            string
+	Status            string
+}
+
+// LCTransfers is returned by getLCTransfers
+type LCTransfers struct {
+	ContractID      string
+	TransferredFrom string `json:"TransferredFrom,omitempty"`
+	Transfers       []LCTransfer
+}
+
+// isTransferable tells whether Tag40A allows the credit to be transferred. Only the exact form of credit
+// IRREVOCABLE TRANSFERABLE does; NON-TRANSFERABLE and similar wordings do not.
+func isTransferable(tag40A string) bool {
+	return strings.Join(strings.Fields(strings.ToUpper(tag40A)), " ") == "IRREVOCABLE TRANSFERABLE"
+}
+
+// tag31DDate returns the date part of Tag31D, e.g. "12/31/2017 Rotterdam"
+func tag31DDate(tag31D string) (time.Time, error) {
+	fields := strings.Fields(tag31D)
+	if len(fields) == 0 {
+		return time.Time{}, errors.New("Tag31D has no expiry date")
+	}
+	return time.Parse(time_format, fields[0])
+}
+
+func getTransferParent(stub shim.ChaincodeStubInterface, UID string) (string, error) {
+	parent, err := stub.GetState(LC_TRANSFER_PARENT + UID)
+	if err != nil {
+		return "", errors.New("Failed to get state for " + LC_TRANSFER_PARENT + UID)
+	}
+	return string(parent), nil
+}
+
+func getTransferredCredits(stub shim.ChaincodeStubInterface, UID string) ([]string, error) {
+	var children []string
+	recBytes, err := stub.GetState(LC_TRANSFERS + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + LC_TRANSFERS + UID)
+	}
+	if recBytes != nil {
+		err = json.Unmarshal(recBytes, &children)
+		if err != nil {
+			return nil, errors.New("Failed to unmarshal transfers of " + UID)
+		}
+	}
+	return children, nil
+}
+
+// getContractRow reads the BPTable row of a contract
+func getContractRow(stub shim.ChaincodeStubInterface, UID string) (shim.Row, error) {
+	var columns []shim.Column
+	col1 := shim.Column{Value: &shim.Column_String_{String_: "BP"}}
+	columns = append(columns, col1)
+	col2 := shim.Column{Value: &shim.Column_String_{String_: UID}}
+	columns = append(columns, col2)
+
+	row, err := stub.GetRow("BPTable", columns)
+	if err != nil {
+		return row, fmt.Errorf("Error: Failed retrieving document with ContractNo %s. Error %s", UID, err.Error())
+	}
+	if len(row.Columns) == 0 {
+		return row, errors.New("No contract exists for " + UID)
+	}
+	return row, nil
+}
+
+// transferLC transfers part of a transferable credit to a second beneficiary as a new contract.
+// args: parent UID, child UID, LCTransferRequest JSON
+func (t *TF) transferLC(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	parentUID := args[0]
+	childUID := args[1]
+	var request LCTransferRequest
+	err := json.Unmarshal([]byte(args[2]), &request)
+	if err != nil {
+		return nil, errors.New("Transfer request should be a JSON object " + err.Error())
+	}
+	if request.SecondBeneficiary == "" {
+		return nil, errors.New("SecondBeneficiary: required field not provided")
+	}
+
+	parentRow, err := getContractRow(stub, parentUID)
+	if err != nil {
+		return nil, err
+	}
+	status, _, err := t.lc.GetStatus(stub, []string{parentUID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) != "ACCEPTED_BY_EB" {
+		return nil, errors.New("Only an LC accepted by the exporter bank can be transferred; LC " + parentUID + " is " + string(status))
+	}
+	grandParent, err := getTransferParent(stub, parentUID)
+	if err != nil {
+		return nil, err
+	}
+	if grandParent != "" {
+		return nil, errors.New("LC " + parentUID + " was itself transferred from " + grandParent + " and cannot be transferred again")
+	}
+
+	parentJSON, err := t.lc.GetJSON(stub, []string{parentUID})
+	if err != nil {
+		return nil, err
+	}
+	err = requireDecrypted(parentUID, parentJSON)
+	if err != nil {
+		return nil, err
+	}
+	var parent LC
+	err = json.Unmarshal(parentJSON, &parent)
+	if err != nil {
+		return nil, err
+	}
+	if !isTransferable(parent.Tag40A) {
+		return nil, errors.New("LC " + parentUID + " is not transferable: Tag40A is " + parent.Tag40A)
+	}
+
+	// The amount transferred, together with earlier transfers, cannot exceed the credit
+	if request.Tag32B == "" {
+		request.Tag32B = parent.Tag32B
+	}
+	parentCurrency, parentAmount, err := parseTag32B(parent.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	currency, amount, err := parseTag32B(request.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	if currency != parentCurrency {
+		return nil, errors.New("A transferred credit must be in " + parentCurrency)
+	}
+	children, err := getTransferredCredits(stub, parentUID)
+	if err != nil {
+		return nil, err
+	}
+	transferred := amount
+	for _, child := range children {
+		childJSON, err := t.lc.getStoredJSON(stub, []string{child})
+		if err != nil {
+			return nil, err
+		}
+		var childLC LC
+		json.Unmarshal(childJSON, &childLC)
+		_, childAmount, err := parseTag32B(childLC.Tag32B)
+		if err != nil {
+			return nil, errors.New("Cannot read the amount of transferred credit " + child + ". Supply its key.")
+		}
+		transferred += childAmount
+	}
+	if transferred > parentAmount+0.005 {
+		return nil, fmt.Errorf("Transfers of %.2f would exceed the credit amount %.2f", transferred, parentAmount)
+	}
+
+	// Shipment and expiry may only be brought forward
+	if request.Tag44C == "" {
+		request.Tag44C = parent.Tag44C
+	}
+	if request.Tag31D == "" {
+		request.Tag31D = parent.Tag31D
+	}
+	parentShipment, err := time.Parse(time_format, parent.Tag44C)
+	if err != nil {
+		return nil, errors.New("Incorrect date format for Tag44C of the original credit. Expecting mm/dd/yyyy; " + parent.Tag44C)
+	}
+	childShipment, err := time.Parse(time_format, request.Tag44C)
+	if err != nil {
+		return nil, errors.New("Incorrect date format for Tag44C. Expecting mm/dd/yyyy; " + request.Tag44C)
+	}
+	if childShipment.After(parentShipment) {
+		return nil, errors.New("Latest date of shipment of a transferred credit cannot be later than " + parent.Tag44C)
+	}
+	parentExpiry, err := tag31DDate(parent.Tag31D)
+	if err != nil {
+		return nil, err
+	}
+	childExpiry, err := tag31DDate(request.Tag31D)
+	if err != nil {
+		return nil, err
+	}
+	if childExpiry.After(parentExpiry) {
+		return nil, errors.New("Expiry of a transferred credit cannot be later than that of the original credit")
+	}
+
+	// The transferred credit keeps the terms and number of the original credit, so the documents
+	// of the second beneficiary can be presented under it after invoice substitution
+	var childDoc map[string]interface{}
+	err = json.Unmarshal(parentJSON, &childDoc)
+	if err != nil {
+		return nil, err
+	}
+	childDoc["Tag40A"] = strings.TrimSpace(strings.Replace(strings.ToUpper(parent.Tag40A), "TRANSFERABLE", "", 1))
+	childDoc["Tag59"] = request.SecondBeneficiary
+	childDoc["Tag32B"] = request.Tag32B
+	childDoc["Tag44C"] = request.Tag44C
+	childDoc["Tag31D"] = request.Tag31D
+	if request.Tag48 != "" {
+		childDoc["Tag48"] = request.Tag48
+	}
+	if request.Applicant != "" {
+		childDoc["Tag50"] = request.Applicant
+	}
+	childJSON, _ := json.Marshal(childDoc)
+
+	secondBeneficiaryBank := request.SecondBeneficiaryBank
+	if secondBeneficiaryBank == "" {
+		secondBeneficiaryBank = parentRow.Columns[6].GetString_()
+	}
+
+	ok, err := stub.InsertRow("BPTable", shim.Row{
+		Columns: []*shim.Column{
+			&shim.Column{Value: &shim.Column_String_{String_: "BP"}},
+			&shim.Column{Value: &shim.Column_String_{String_: childUID}},
+			&shim.Column{Value: &shim.Column_String_{String_: "STARTED"}},
+			&shim.Column{Value: &shim.Column_String_{String_: parentRow.Columns[3].GetString_()}},
+			&shim.Column{Value: &shim.Column_String_{String_: request.SecondBeneficiary}},
+			&shim.Column{Value: &shim.Column_String_{String_: parentRow.Columns[5].GetString_()}},
+			&shim.Column{Value: &shim.Column_String_{String_: secondBeneficiaryBank}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("")}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("")}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("")}},
+			&shim.Column{Value: &shim.Column_Bytes{Bytes: []byte("")}},
+			&shim.Column{Value: &shim.Column_String_{String_: ""}},
+			&shim.Column{Value: &shim.Column_String_{String_: ""}}},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("Row already exists.")
+	}
+
+	_, err = t.lc.SubmitDoc(stub, []string{childUID, string(childJSON), ""})
+	if err != nil {
+		return nil, err
+	}
+	err = recordFingerprints(stub, childUID, "LC", string(childJSON), "", parentRow.Columns[6].GetString_(), "ExporterBank")
+	if err != nil {
+		return nil, err
+	}
+
+	err = stub.PutState(LC_TRANSFER_PARENT+childUID, []byte(parentUID))
+	if err != nil {
+		return nil, err
+	}
+	children = append(children, childUID)
+	childrenBytes, _ := json.Marshal(children)
+	err = stub.PutState(LC_TRANSFERS+parentUID, childrenBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = t.contractChanged(stub, childUID, "", "", "", "")
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.contractChanged(stub, parentUID, "", "", "", "")
+}
+
+// presentTransferredDocs presents the documents of a transferred credit under the original credit, with the
+// first beneficiary's invoice substituted for the second beneficiary's. args: child UID, invoiceJSON, invoicePDF
+func (t *TF) presentTransferredDocs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	childUID := args[0]
+	invoiceJSON := args[1]
+	parentUID, err := getTransferParent(stub, childUID)
+	if err != nil {
+		return nil, err
+	}
+	if parentUID == "" {
+		return nil, errors.New("LC " + childUID + " is not a transferred credit")
+	}
+
+	edStatus, err := t.bl.GetStatus(stub, []string{childUID})
+	if err != nil {
+		return nil, err
+	}
+	if string(edStatus) != "SUBMITTED_BY_EB" && string(edStatus) != "ACCEPTED_BY_IB" {
+		return nil, errors.New("The second beneficiary has not presented documents under " + childUID)
+	}
+
+	// The substituted invoice may not exceed the original credit
+	parentJSON, err := t.lc.GetJSON(stub, []string{parentUID})
+	if err != nil {
+		return nil, err
+	}
+	err = requireDecrypted(parentUID, parentJSON)
+	if err != nil {
+		return nil, err
+	}
+	var parent LC
+	json.Unmarshal(parentJSON, &parent)
+	currency, amount, err := parseTag32B(parent.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	var invoice Invoice
+	err = json.Unmarshal([]byte(invoiceJSON), &invoice)
+	if err != nil {
+		return nil, err
+	}
+	if invoice.CURRENCY != currency {
+		return nil, errors.New("Currency in the substituted invoice does not match currency in L/C")
+	}
+	if float64(invoice.TOTAL_IN_FIGURES) > amount+0.005 {
+		return nil, fmt.Errorf("The substituted invoice of %d exceeds the original credit of %.2f", invoice.TOTAL_IN_FIGURES, amount)
+	}
+
+	BLJSON, err := t.bl.GetJSON(stub, []string{childUID})
+	if err != nil {
+		return nil, err
+	}
+	if len(BLJSON) == 0 || string(BLJSON) == "{}" {
+		return nil, errors.New("No BL was presented under " + childUID)
+	}
+	packingListJSON, err := t.pl.GetJSON(stub, []string{childUID})
+	if err != nil {
+		return nil, err
+	}
+	if len(packingListJSON) == 0 {
+		packingListJSON = []byte(`{}`)
+	}
+	childRow, err := getContractRow(stub, childUID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The transport documents stay those of the second beneficiary; their PDFs remain anchored under the transferred credit
+	return t.Invoke(stub, "submitED", []string{parentUID, "", args[2], "", string(BLJSON), invoiceJSON, string(packingListJSON),
+		childRow.Columns[11].GetString_(), childRow.Columns[12].GetString_()})
+}
+
+// getLCTransfers returns the credit an LC was transferred from and the credits transferred from it; args: UID
+func (t *TF) getLCTransfers(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	var result LCTransfers
+	result.ContractID = args[0]
+	parent, err := getTransferParent(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	result.TransferredFrom = parent
+
+	children, err := getTransferredCredits(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	result.Transfers = make([]LCTransfer, 0)
+	for _, child := range children {
+		childJSON, err := t.lc.GetJSON(stub, []string{child})
+		if err != nil {
+			return nil, err
+		}
+		var childLC LC
+		json.Unmarshal(childJSON, &childLC)
+		status, _, err := t.lc.GetStatus(stub, []string{child})
+		if err != nil {
+			return nil, err
+		}
+		result.Transfers = append(result.Transfers, LCTransfer{ContractID: child, SecondBeneficiary: childLC.Tag59, Tag32B: childLC.Tag32B, Status: string(status)})
+	}
+	return json.Marshal(result)
+}
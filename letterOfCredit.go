@@ -4,6 +4,9 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
 
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 )
@@ -40,11 +43,28 @@ type LC struct {
 	Tag71B string //Charges
 	Tag48  string //Period for Presentation
 	Tag49  string //Confirmation Instructions
-	//Tag53A string //Reimbursing Bank – BIC
+	Tag53A string //Reimbursing Bank – BIC
 	//Tag78  string //Instruction to Paying/Accepting/Negotiating Bank
 	Tag57D string //`Advise Through` Bank -Name&Addr
 }
 
+//tag32BFormat is SWIFT field 32B: a currency code and an amount of at most 15 characters whose only
+//separator is the decimal comma, e.g. "USD12500,00". Amounts written without the comma are whole amounts.
+var tag32BFormat = regexp.MustCompile(`^([A-Z]{3})([0-9]+(,[0-9]*)?)$`)
+
+//parseTag32B splits Tag32B such as "USD12500,00" into the currency code and the amount
+func parseTag32B(tag32B string) (string, float64, error) {
+	match := tag32BFormat.FindStringSubmatch(strings.TrimSpace(tag32B))
+	if match == nil || len(match[2]) > 15 {
+		return "", 0, errors.New("Tag32B should be a currency code and an amount with a decimal comma and no thousands separators, e.g. USD12500,00; " + tag32B)
+	}
+	amount, err := strconv.ParseFloat(strings.TrimRight(strings.Replace(match[2], ",", ".", 1), "."), 64)
+	if err != nil {
+		return "", 0, errors.New("Tag32B amount is not a number; " + tag32B)
+	}
+	return match[1], amount, nil
+}
+
 //Init initializes the document smart contract
 func (t *LC) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	// Check if table already exists
@@ -175,6 +195,12 @@ func (t *LC) SubmitDoc(stub shim.ChaincodeStubInterface, args []string) ([]byte,
 		return nil, errors.New("Document validation failed.")
 	}
 
+	// Validation ran on the plaintext; sensitive fields are stored encrypted if the caller supplied a key
+	docJSON, err = encryptJSONFields(stub, UID, docJSON, sensitiveLCFields)
+	if err != nil {
+		return nil, err
+	}
+
 	// Insert a row
 	ok, err := stub.InsertRow("LCTable", shim.Row{
 		Columns: []*shim.Column{
@@ -208,6 +234,11 @@ func (t *LC) ReSubmitDoc(stub shim.ChaincodeStubInterface, args []string) ([]byt
 	docPDF := []byte(args[2])
 	isReSubmission := "true"
 	comment := args[3]
+
+	docJSON, err := encryptJSONFields(stub, UID, docJSON, sensitiveLCFields)
+	if err != nil {
+		return nil, err
+	}
 	
 	var columns []shim.Column
 	col1 := shim.Column{Value: &shim.Column_String_{String_: "DOC"}}
@@ -410,8 +441,17 @@ func (t *LC) UpdateStatus(stub shim.ChaincodeStubInterface, args []string) ([]by
 
 }
 
-// GetJSON () – returns as JSON a single document w.r.t. the UID
+// GetJSON () – returns as JSON a single document w.r.t. the UID, decrypted if the caller supplied the contract key
 func (t *LC) GetJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	docJSON, err := t.getStoredJSON(stub, args)
+	if err != nil || docJSON == nil {
+		return docJSON, err
+	}
+	return decryptJSONFields(stub, args[0], docJSON, sensitiveLCFields)
+}
+
+// getStoredJSON () – returns the document as stored on the ledger, sensitive fields possibly encrypted
+func (t *LC) getStoredJSON(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	if len(args) != 1 {
 		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
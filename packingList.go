@@ -34,6 +34,7 @@ type PLRow struct {
 	QUANTITY_MTONS       int
 	NET_WEIGHT_KGS       int
 	GROSS_WEIGHT_KGS     int
+	HS_CODE              string
 }
 
 //Init initializes the document smart contract
@@ -122,7 +123,7 @@ func (t *PL) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byt
 		return []byte("Error: Required field not provided."), nil
 	} else if plDataStruct.DELIVERY_TERMS == "" {
 		return []byte("Error: Required field not provided."), nil
-	} else if plDataStruct.DOCUMENTARY_CREDIT_NUMBER == "" {
+	} else if plDataStruct.DOCUMENTARY_CREDIT_NUMBER == "" && len(lcJSON) != 0 {
 		return []byte("Error: Required field not provided."), nil
 	} else if plDataStruct.METHOD_OF_LOADING == "" {
 		return []byte("Error: Required field not provided."), nil
@@ -136,6 +137,12 @@ func (t *PL) ValidateDoc(stub shim.ChaincodeStubInterface, args []string) ([]byt
 		return []byte("Error: Required field not provided."), nil
 	}
 
+	// Documents presented under a collection have no LC to be checked against
+	if len(lcJSON) == 0 {
+		resultMap["result"] = "Success: All validation checks passed"
+		return json.Marshal(resultMap)
+	}
+
 	var lcStruct LC
 	err = json.Unmarshal(lcJSON, &lcStruct)
 	if err != nil {
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+const PACS008_NAMESPACE = "urn:iso:std:iso:20022:tech:xsd:pacs.008.001.08"
+
+// ISO 20022 dates are yyyy-mm-dd
+const iso_date_format = "2006-01-02"
+
+var bicPattern = regexp.MustCompile(`^[A-Z]{6}[A-Z0-9]{2}([A-Z0-9]{3})?$`)
+
+// Pacs008 is the subset of an ISO 20022 FIToFICustomerCreditTransfer needed to pay an LC
+type Pacs008 struct {
+	XMLName  xml.Name `xml:"Document"`
+	Xmlns    string   `xml:"xmlns,attr"`
+	Transfer struct {
+		GrpHdr struct {
+			MsgId    string
+			CreDtTm  string
+			NbOfTxs  int
+			SttlmMtd string `xml:"SttlmInf>SttlmMtd"`
+		}
+		CdtTrfTxInf struct {
+			InstrId        string `xml:"PmtId>InstrId"`
+			EndToEndId     string `xml:"PmtId>EndToEndId"`
+			TxId           string `xml:"PmtId>TxId"`
+			IntrBkSttlmAmt IsoAmount
+			IntrBkSttlmDt  string
+			ChrgBr         string
+			Dbtr           IsoParty
+			DbtrAgt        IsoAgent
+			CdtrAgt        IsoAgent
+			Cdtr           IsoParty
+			RmtInf         string `xml:"RmtInf>Ustrd"`
+		}
+	} `xml:"FIToFICstmrCdtTrf"`
+}
+
+// IsoAmount is an amount with its currency attribute
+type IsoAmount struct {
+	Ccy   string `xml:"Ccy,attr"`
+	Value string `xml:",chardata"`
+}
+
+// IsoParty is a debtor or creditor named with an unstructured address
+type IsoParty struct {
+	Nm      string
+	PstlAdr *IsoAddress `xml:",omitempty"`
+}
+
+// IsoAddress is an unstructured postal address
+type IsoAddress struct {
+	AdrLine []string
+}
+
+// IsoAgent is a bank identified by BIC or, failing that, by name
+type IsoAgent struct {
+	BICFI string `xml:"FinInstnId>BICFI,omitempty"`
+	Nm    string `xml:"FinInstnId>Nm,omitempty"`
+}
+
+// Camt054 is the subset of an ISO 20022 BankToCustomerDebitCreditNotification read to confirm payments
+type Camt054 struct {
+	Notifications []struct {
+		Entries []struct {
+			Amt       IsoAmount
+			CdtDbtInd string
+			Sts       struct {
+				Value string `xml:",chardata"`
+				Cd    string
+			}
+			BookgDt     string `xml:"BookgDt>Dt"`
+			ValDt       string `xml:"ValDt>Dt"`
+			AcctSvcrRef string
+			Details     []struct {
+				Refs struct {
+					AcctSvcrRef string
+					TxId        string
+					EndToEndId  string
+				}
+				Amt     IsoAmount
+				DbtrAgt IsoAgent `xml:"RltdAgts>DbtrAgt"`
+				CdtrAgt IsoAgent `xml:"RltdAgts>CdtrAgt"`
+			} `xml:"NtryDtls>TxDtls"`
+		} `xml:"Ntry"`
+	} `xml:"BkToCstmrDbtCdtNtfctn>Ntfctn"`
+}
+
+// PaymentConfirmation reports how a camt.054 entry was applied
+type PaymentConfirmation struct {
+	EndToEndId string
+	Amount     string
+	Currency   string
+	Reference  string
+	Applied    bool
+	Reason     string `json:",omitempty"`
+}
+
+// paymentInstructionData gathers what a payment instruction for an LC needs
+type paymentInstructionData struct {
+	UID          string
+	LC           LC
+	Invoice      Invoice
+	Settlement   *Settlement
+	ImporterBank string
+	ExporterBank string
+}
+
+func (t *TF) getPaymentInstructionData(stub shim.ChaincodeStubInterface, UID string) (*paymentInstructionData, error) {
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+		return nil, errors.New("Payment is not yet due.")
+	}
+
+	data := paymentInstructionData{UID: UID}
+	data.Settlement, err = getSettlement(stub, "LC", UID)
+	if err != nil {
+		return nil, err
+	}
+	if data.Settlement == nil {
+		return nil, errors.New("No payment is due on " + UID)
+	}
+	if data.Settlement.Outstanding <= 0 {
+		return nil, errors.New("Contract " + UID + " is already settled")
+	}
+
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	err = requireDecrypted(UID, lcJSON)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(lcJSON, &data.LC)
+	if err != nil {
+		return nil, err
+	}
+
+	invoiceJSON, err := t.invoice.GetJSON(stub, []string{UID})
+	if err == nil && len(invoiceJSON) != 0 && requireDecrypted(UID, invoiceJSON) == nil {
+		json.Unmarshal(invoiceJSON, &data.Invoice)
+	}
+
+	row, err := getContractRow(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	data.ImporterBank = row.Columns[5].GetString_()
+	data.ExporterBank = row.Columns[6].GetString_()
+	return &data, nil
+}
+
+// remittanceInfo identifies the credit and invoice being paid
+func (d *paymentInstructionData) remittanceInfo() string {
+	info := "LC " + d.LC.Tag20
+	if d.Invoice.INVOICE_NUMBER != 0 {
+		info += " INVOICE " + strconv.Itoa(d.Invoice.INVOICE_NUMBER)
+	}
+	return info
+}
+
+// bankAgent uses the SWIFT address of the LC message when it is a BIC, and the contract's bank name otherwise
+func bankAgent(address string, name string) IsoAgent {
+	if bicPattern.MatchString(address) {
+		return IsoAgent{BICFI: address}
+	}
+	return IsoAgent{Nm: name}
+}
+
+// partyLines splits a multi-line party field such as Tag50 or Tag59 into name and address lines
+func partyLines(field string) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.Replace(field, "\r\n", "\n", -1), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+func isoParty(field string) IsoParty {
+	lines := partyLines(field)
+	party := IsoParty{Nm: lines[0]}
+	if len(lines) > 1 {
+		party.PstlAdr = &IsoAddress{AdrLine: lines[1:]}
+	}
+	return party
+}
+
+func (d *paymentInstructionData) pacs008(created time.Time) ([]byte, error) {
+	dueDate, err := time.Parse(time_format, d.Settlement.DueDate)
+	if err != nil {
+		return nil, errors.New("Due date of " + d.UID + " is not a date")
+	}
+
+	var msg Pacs008
+	msg.Xmlns = PACS008_NAMESPACE
+	msg.Transfer.GrpHdr.MsgId = d.UID + "-" + strconv.Itoa(len(d.Settlement.Payments)+1)
+	msg.Transfer.GrpHdr.CreDtTm = created.Format("2006-01-02T15:04:05")
+	msg.Transfer.GrpHdr.NbOfTxs = 1
+	msg.Transfer.GrpHdr.SttlmMtd = "INDA"
+
+	tx := &msg.Transfer.CdtTrfTxInf
+	tx.InstrId = msg.Transfer.GrpHdr.MsgId
+	tx.EndToEndId = d.UID
+	tx.TxId = msg.Transfer.GrpHdr.MsgId
+	tx.IntrBkSttlmAmt = IsoAmount{Ccy: d.Settlement.Currency, Value: fmt.Sprintf("%.2f", d.Settlement.Outstanding)}
+	tx.IntrBkSttlmDt = dueDate.Format(iso_date_format)
+	tx.ChrgBr = "SHAR"
+	tx.Dbtr = isoParty(d.LC.Tag50)
+	tx.DbtrAgt = bankAgent(d.LC.Sender, d.ImporterBank)
+	tx.CdtrAgt = bankAgent(d.LC.Receiver, d.ExporterBank)
+	tx.Cdtr = isoParty(d.LC.Tag59)
+	tx.RmtInf = d.remittanceInfo()
+
+	body, err := xml.MarshalIndent(msg, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+// mtField writes a field of an MT message, with the value cut to the given number of lines of 35 characters
+func mtField(b *bytes.Buffer, tag string, lines []string, maxLines int) {
+	if len(lines) > maxLines {
+		lines = lines[:maxLines]
+	}
+	for i, line := range lines {
+		if len(line) > 35 {
+			line = line[:35]
+		}
+		if i == 0 {
+			b.WriteString(":" + tag + ":")
+		}
+		b.WriteString(line + "\n")
+	}
+}
+
+func (d *paymentInstructionData) mt103() ([]byte, error) {
+	dueDate, err := time.Parse(time_format, d.Settlement.DueDate)
+	if err != nil {
+		return nil, errors.New("Due date of " + d.UID + " is not a date")
+	}
+
+	reference := d.UID
+	if len(reference) > 16 {
+		reference = reference[:16]
+	}
+	amount := strings.Replace(fmt.Sprintf("%.2f", d.Settlement.Outstanding), ".", ",", 1)
+
+	var b bytes.Buffer
+	mtField(&b, "20", []string{reference}, 1)
+	mtField(&b, "23B", []string{"CRED"}, 1)
+	mtField(&b, "32A", []string{dueDate.Format("060102") + d.Settlement.Currency + amount}, 1)
+	mtField(&b, "50K", partyLines(d.LC.Tag50), 4)
+	if bicPattern.MatchString(d.LC.Sender) {
+		mtField(&b, "52A", []string{d.LC.Sender}, 1)
+	} else {
+		mtField(&b, "52D", []string{d.ImporterBank}, 4)
+	}
+	if bicPattern.MatchString(d.LC.Receiver) {
+		mtField(&b, "57A", []string{d.LC.Receiver}, 1)
+	} else {
+		mtField(&b, "57D", []string{d.ExporterBank}, 4)
+	}
+	mtField(&b, "59", partyLines(d.LC.Tag59), 4)
+	mtField(&b, "70", []string{d.remittanceInfo()}, 4)
+	mtField(&b, "71A", []string{"SHA"}, 1)
+	return []byte(b.String()), nil
+}
+
+// getPaymentInstruction builds the transfer paying the outstanding balance of an LC; args: UID, optional format PACS008 (default) or MT103
+func (t *TF) getPaymentInstruction(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2.")
+	}
+	format := "PACS008"
+	if len(args) == 2 && args[1] != "" {
+		format = strings.ToUpper(args[1])
+	}
+
+	data, err := t.getPaymentInstructionData(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	switch format {
+	case "PACS008":
+		created, err := txDate(stub)
+		if err != nil {
+			return nil, err
+		}
+		return data.pacs008(created)
+	case "MT103":
+		return data.mt103()
+	}
+	return nil, errors.New("Format should be PACS008 or MT103")
+}
+
+// isoToTFDate converts a yyyy-mm-dd date to the mm/dd/yyyy used on the ledger
+func isoToTFDate(date string) string {
+	parsed, err := time.Parse(iso_date_format, strings.TrimSpace(date))
+	if err != nil {
+		return ""
+	}
+	return parsed.Format(time_format)
+}
+
+// importPaymentConfirmation applies the credits of a camt.054 notification to the contracts named
+// by their end-to-end ids, as paymentReceived would; args: camt.054 XML.
+// Every credit is checked before any is applied. Credits that name no contract with a payment due, or
+// that the settlement would not take, are reported unapplied; if applying a checked credit fails the
+// whole notification fails.
+func (t *TF) importPaymentConfirmation(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	var notification Camt054
+	err := xml.Unmarshal([]byte(args[0]), &notification)
+	if err != nil {
+		return nil, errors.New("Payment confirmation should be a camt.054 XML document " + err.Error())
+	}
+
+	confirmations := make([]PaymentConfirmation, 0)
+	// payments holds the paymentReceived argument of each confirmation to apply, "" for the others
+	payments := make([]string, 0)
+	// settlements are checked in memory so that credits to the same contract add up
+	settlements := map[string]*Settlement{}
+	for _, ntfctn := range notification.Notifications {
+		for _, entry := range ntfctn.Entries {
+			if entry.CdtDbtInd != "CRDT" {
+				continue
+			}
+			// the status is a plain code before camt.054.001.08 and a Cd element from it on
+			status := strings.TrimSpace(entry.Sts.Value)
+			if entry.Sts.Cd != "" {
+				status = entry.Sts.Cd
+			}
+			if status != "" && status != "BOOK" {
+				continue
+			}
+			valueDate := isoToTFDate(entry.ValDt)
+			if valueDate == "" {
+				valueDate = isoToTFDate(entry.BookgDt)
+			}
+
+			if len(entry.Details) == 0 {
+				confirmations = append(confirmations, PaymentConfirmation{Amount: strings.TrimSpace(entry.Amt.Value), Currency: entry.Amt.Ccy, Reference: entry.AcctSvcrRef,
+					Reason: "The entry has no transaction details to give the end-to-end id"})
+				payments = append(payments, "")
+				continue
+			}
+			for _, details := range entry.Details {
+				amount := details.Amt
+				if amount.Value == "" {
+					amount = entry.Amt
+				}
+				reference := details.Refs.TxId
+				if reference == "" {
+					reference = details.Refs.AcctSvcrRef
+				}
+				if reference == "" {
+					reference = entry.AcctSvcrRef
+				}
+				confirmation := PaymentConfirmation{EndToEndId: details.Refs.EndToEndId, Amount: strings.TrimSpace(amount.Value), Currency: amount.Ccy, Reference: reference}
+				paymentJSON, _ := json.Marshal(map[string]string{
+					"Amount":    confirmation.Amount,
+					"Currency":  confirmation.Currency,
+					"ValueDate": valueDate,
+					"PayerBank": details.DbtrAgt.BICFI + details.DbtrAgt.Nm,
+					"PayeeBank": details.CdtrAgt.BICFI + details.CdtrAgt.Nm,
+					"Reference": reference,
+				})
+				confirmation.Reason, err = t.checkPaymentConfirmation(stub, confirmation.EndToEndId, string(paymentJSON), settlements)
+				if err != nil {
+					return nil, err
+				}
+				confirmations = append(confirmations, confirmation)
+				if confirmation.Reason != "" {
+					payments = append(payments, "")
+				} else {
+					payments = append(payments, string(paymentJSON))
+				}
+			}
+		}
+	}
+
+	for i := range confirmations {
+		if payments[i] == "" {
+			continue
+		}
+		_, err = t.Invoke(stub, "paymentReceived", []string{confirmations[i].EndToEndId, payments[i]})
+		if err != nil {
+			return nil, errors.New("Payment " + confirmations[i].Reference + " to " + confirmations[i].EndToEndId + " could not be applied: " + err.Error())
+		}
+		confirmations[i].Applied = true
+	}
+	return json.Marshal(confirmations)
+}
+
+// checkPaymentConfirmation returns why a credit cannot be applied to a contract, or "" if it can. The credit
+// is booked against the in-memory settlement of the contract so that later credits are checked after it.
+func (t *TF) checkPaymentConfirmation(stub shim.ChaincodeStubInterface, UID string, paymentJSON string, settlements map[string]*Settlement) (string, error) {
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if UID == "" || err != nil || string(status) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+		return "No payment is due on a contract with this end-to-end id", nil
+	}
+	payment, err := parsePayment(paymentJSON)
+	if err != nil {
+		return err.Error(), nil
+	}
+	settlement, ok := settlements[UID]
+	if !ok {
+		settlement, err = t.openLCSettlement(stub, UID)
+		if err != nil {
+			return "", err
+		}
+		settlements[UID] = settlement
+	}
+	err = settlement.addPayment(stub, *payment)
+	if err != nil {
+		return err.Error(), nil
+	}
+	return "", nil
+}
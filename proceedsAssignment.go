@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// PROCEEDS_ASSIGNMENTS holds the assignments of proceeds of a contract: PROCEEDS_ASSIGNMENTS + UID
+const PROCEEDS_ASSIGNMENTS = "ASSIGN_"
+
+// PROCEEDS_DISTRIBUTION holds how the proceeds of a paid contract were split: PROCEEDS_DISTRIBUTION + UID
+const PROCEEDS_DISTRIBUTION = "PROCEEDS_"
+
+// Assignment states
+const (
+	ASSIGNMENT_PENDING      = "PENDING_ACKNOWLEDGEMENT"
+	ASSIGNMENT_ACKNOWLEDGED = "ACKNOWLEDGED"
+	ASSIGNMENT_REFUSED      = "REFUSED"
+)
+
+// ProceedsAssignment assigns part of the proceeds of an LC to a third party (UCP 600 article 39).
+// Either Amount or Percentage is given.
+type ProceedsAssignment struct {
+	AssignmentNo int
+	Assignee     string
+	Amount       float64 `json:"Amount,omitempty"`
+	Percentage   float64 `json:"Percentage,omitempty"`
+	Reference    string  `json:"Reference,omitempty"`
+	Status       string
+	Comment      string `json:"Comment,omitempty"`
+}
+
+// ProceedsShare is the part of the proceeds paid to one party
+type ProceedsShare struct {
+	Party        string
+	AssignmentNo int `json:"AssignmentNo,omitempty"`
+	Amount       float64
+}
+
+// ProceedsDistribution records how the proceeds of a contract were split on payment
+type ProceedsDistribution struct {
+	ContractID string
+	Currency   string
+	Total      float64
+	Charges    float64 `json:"Charges,omitempty"`
+	Shares     []ProceedsShare
+}
+
+func getAssignments(stub shim.ChaincodeStubInterface, UID string) ([]ProceedsAssignment, error) {
+	assignments := make([]ProceedsAssignment, 0)
+	recBytes, err := stub.GetState(PROCEEDS_ASSIGNMENTS + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + PROCEEDS_ASSIGNMENTS + UID)
+	}
+	if recBytes != nil {
+		err = json.Unmarshal(recBytes, &assignments)
+		if err != nil {
+			return nil, errors.New("Failed to unmarshal assignments of " + UID)
+		}
+	}
+	return assignments, nil
+}
+
+func putAssignments(stub shim.ChaincodeStubInterface, UID string, assignments []ProceedsAssignment) error {
+	recBytes, _ := json.Marshal(assignments)
+	return stub.PutState(PROCEEDS_ASSIGNMENTS+UID, recBytes)
+}
+
+// contractAmount returns the currency and amount an LC contract pays: the invoice total once an invoice
+// has been presented, otherwise the LC amount
+func (t *TF) contractAmount(stub shim.ChaincodeStubInterface, UID string) (string, float64, error) {
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return "", 0, err
+	}
+	if len(lcJSON) == 0 {
+		return "", 0, errors.New("No LC exists for " + UID)
+	}
+	err = requireDecrypted(UID, lcJSON)
+	if err != nil {
+		return "", 0, err
+	}
+	var lc LC
+	err = json.Unmarshal(lcJSON, &lc)
+	if err != nil {
+		return "", 0, err
+	}
+	currency, amount, err := parseTag32B(lc.Tag32B)
+	if err != nil {
+		return "", 0, err
+	}
+
+	invoiceJSON, err := t.invoice.GetJSON(stub, []string{UID})
+	if err != nil {
+		return "", 0, err
+	}
+	if len(invoiceJSON) != 0 && string(invoiceJSON) != "{}" {
+		err = requireDecrypted(UID, invoiceJSON)
+		if err != nil {
+			return "", 0, err
+		}
+		var invoice Invoice
+		if json.Unmarshal(invoiceJSON, &invoice) == nil && invoice.TOTAL_IN_FIGURES > 0 {
+			amount = float64(invoice.TOTAL_IN_FIGURES)
+		}
+	}
+	return currency, amount, nil
+}
+
+// assignedAmount returns what an assignment takes out of the given proceeds
+func (a *ProceedsAssignment) assignedAmount(proceeds float64) float64 {
+	if a.Percentage > 0 {
+		return math.Floor(proceeds*a.Percentage) / 100
+	}
+	return a.Amount
+}
+
+// assignProceeds records an assignment of proceeds made by the beneficiary.
+// args: UID, assignee, amount or percentage (e.g. "2500.00" or "20%"), reference
+func (t *TF) assignProceeds(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	if accessControlFlag == true {
+		res, err := t.isCallerExporter(stub, []string{args[0]})
+		if err != nil {
+			return nil, err
+		}
+		if res == false {
+			return nil, errors.New("Access denied.")
+		}
+	}
+
+	UID := args[0]
+	if args[1] == "" {
+		return nil, errors.New("Assignee: required field not provided")
+	}
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) == "PAYMENT_RECEIVED" {
+		return nil, errors.New("The proceeds of " + UID + " have already been paid")
+	}
+
+	assignment := ProceedsAssignment{Assignee: args[1], Reference: args[3], Status: ASSIGNMENT_PENDING}
+	share := args[2]
+	if len(share) > 0 && share[len(share)-1] == '%' {
+		assignment.Percentage, err = strconv.ParseFloat(share[:len(share)-1], 64)
+		if err != nil || assignment.Percentage <= 0 || assignment.Percentage > 100 {
+			return nil, errors.New("Percentage should be between 0 and 100")
+		}
+	} else {
+		assignment.Amount, err = parseDecimal(share)
+		if err != nil || assignment.Amount <= 0 {
+			return nil, errors.New("Amount should be a positive number or a percentage")
+		}
+	}
+
+	// All assignments that may still be acknowledged must fit in the proceeds
+	_, amount, err := t.contractAmount(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := getAssignments(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	total := assignment.assignedAmount(amount)
+	for _, existing := range assignments {
+		if existing.Status != ASSIGNMENT_REFUSED {
+			total += existing.assignedAmount(amount)
+		}
+	}
+	if total > amount+0.005 {
+		return nil, fmt.Errorf("Assignments of %.2f would exceed the proceeds of %.2f", total, amount)
+	}
+
+	assignment.AssignmentNo = len(assignments) + 1
+	assignments = append(assignments, assignment)
+	return nil, putAssignments(stub, UID, assignments)
+}
+
+// acknowledgeAssignment records the exporter bank's acknowledgement or refusal of an assignment.
+// args: UID, assignment number, ACKNOWLEDGED or REFUSED, comment
+func (t *TF) acknowledgeAssignment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	if accessControlFlag == true {
+		res, err := t.isCallerExporterBank(stub, []string{args[0]})
+		if err != nil {
+			return nil, err
+		}
+		if res == false {
+			return nil, errors.New("Access denied.")
+		}
+	}
+
+	decision := args[2]
+	if decision != ASSIGNMENT_ACKNOWLEDGED && decision != ASSIGNMENT_REFUSED {
+		return nil, errors.New("Decision should be ACKNOWLEDGED or REFUSED")
+	}
+	assignmentNo, err := strconv.Atoi(args[1])
+	if err != nil {
+		return nil, errors.New("Assignment number should be a number")
+	}
+	assignments, err := getAssignments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if assignmentNo < 1 || assignmentNo > len(assignments) {
+		return nil, errors.New("No assignment " + args[1] + " exists for " + args[0])
+	}
+	assignment := &assignments[assignmentNo-1]
+	if assignment.Status != ASSIGNMENT_PENDING {
+		return nil, errors.New("Assignment " + args[1] + " is already " + assignment.Status)
+	}
+	assignment.Status = decision
+	assignment.Comment = args[3]
+	return nil, putAssignments(stub, args[0], assignments)
+}
+
+// distributeProceeds splits proceeds received for a contract between the acknowledged assignees and the beneficiary
+func (t *TF) distributeProceeds(stub shim.ChaincodeStubInterface, UID string, currency string, proceeds float64) (*ProceedsDistribution, error) {
+	row, err := getContractRow(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	assignments, err := getAssignments(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+
+	distribution := ProceedsDistribution{ContractID: UID, Currency: currency, Total: proceeds}
+	// the beneficiary's bank charges come out of the proceeds before they are shared
+	distribution.Charges, err = deductBeneficiaryCharges(stub, UID, currency, proceeds)
+	if err != nil {
+		return nil, err
+	}
+	proceeds -= distribution.Charges
+	// a bank that discounted the presentation is repaid before anyone else
+	financier, err := repayFinancing(stub, UID, currency, proceeds)
+	if err != nil {
+		return nil, err
+	}
+	if financier != nil {
+		distribution.Shares = append(distribution.Shares, *financier)
+		proceeds -= financier.Amount
+	}
+	remaining := proceeds
+	for _, assignment := range assignments {
+		if assignment.Status != ASSIGNMENT_ACKNOWLEDGED {
+			continue
+		}
+		share := math.Min(assignment.assignedAmount(proceeds), remaining)
+		remaining -= share
+		distribution.Shares = append(distribution.Shares, ProceedsShare{Party: assignment.Assignee, AssignmentNo: assignment.AssignmentNo, Amount: share})
+	}
+	distribution.Shares = append(distribution.Shares, ProceedsShare{Party: row.Columns[4].GetString_(), Amount: math.Floor(remaining*100+0.5) / 100})
+
+	recBytes, _ := json.Marshal(distribution)
+	err = stub.PutState(PROCEEDS_DISTRIBUTION+UID, recBytes)
+	if err != nil {
+		return nil, err
+	}
+	return &distribution, nil
+}
+
+// getAssignments lists the assignments of proceeds of a contract and, once paid, how the proceeds were split
+func (t *TF) getAssignments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+
+	assignments, err := getAssignments(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	result := struct {
+		ContractID   string
+		Assignments  []ProceedsAssignment
+		Distribution *ProceedsDistribution `json:"Distribution,omitempty"`
+	}{ContractID: args[0], Assignments: assignments}
+
+	recBytes, err := stub.GetState(PROCEEDS_DISTRIBUTION + args[0])
+	if err != nil {
+		return nil, err
+	}
+	if recBytes != nil {
+		result.Distribution = new(ProceedsDistribution)
+		json.Unmarshal(recBytes, result.Distribution)
+	}
+	return json.Marshal(result)
+}
@@ -6,18 +6,46 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 )
 
-//ALL_PO key to refer the purchaseOrder master data
+//ALL_PO key to refer the purchaseOrder master data written before POs were indexed; only read by reindexPOs
 const ALL_PO = "ALL_PO"
 
+//PO_INDEX prefixes the secondary index keys kept for every PO: PO_INDEX~<field>~<value>~<PO number>
+const PO_INDEX = "POIDX"
+
+//poIndexFields are the PO fields with a secondary index. "All" indexes every PO.
+var poIndexFields = []string{"All", "Importer", "Exporter", "ExporterBank", "ShippingCompany", "Status"}
+
+//LC_PO_PREFIX prefixes the key mapping an LC contract ID in BPTable to the PO it was raised for
+const LC_PO_PREFIX = "LC_PO_"
+
+//isoCurrencyCodes are the active ISO 4217 alphabetic codes accepted on a PO
+var isoCurrencyCodes = toSet(strings.Fields(`AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND BOB BRL BSD BTN BWP BYN BZD
+	CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD
+	HKD HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW KWD KYD KZT LAK LBP LKR LRD LSL LYD
+	MAD MDL MGA MKD MMK MNT MOP MRU MUR MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN PYG
+	QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS
+	UAH UGX USD UYU UZS VES VND VUV WST XAF XCD XOF XPF YER ZAR ZMW ZWL`))
+
+//incoterms2020 are the rules accepted as the first word of TermsofTrade, e.g. "FOB Shanghai"
+var incoterms2020 = toSet([]string{"EXW", "FCA", "FAS", "FOB", "CFR", "CIF", "CPT", "CIP", "DAP", "DPU", "DDP"})
+
 var logger = shim.NewLogger("PurchaseOrder")
 
 type PurchaseOrder struct {
+	ContractId          string `json:"ContractId,omitempty"`
 	RefNo               string
 	Importer            string
 	Exporter            string
+	ImporterBank        string `json:"ImporterBank,omitempty"`
+	ExporterBank        string `json:"ExporterBank,omitempty"`
+	ShippingCompany     string `json:"ShippingCompany,omitempty"`
+	InsuranceCompany    string `json:"InsuranceCompany,omitempty"`
 	Commodity           string
 	Aircompressor       string
 	Currency            string
@@ -25,6 +53,7 @@ type PurchaseOrder struct {
 	Amount              string
 	Quantity            string
 	Weight              string
+	LineItems           []POLineItem
 	TermsofPayment      string
 	TermsofTrade        string
 	TermsofInsurance    string
@@ -35,12 +64,102 @@ type PurchaseOrder struct {
 	PortofDischarge     string
 	PaymentDate         string
 	PORejectReason      string
+	IsLCRequired        string `json:"IsLCRequired,omitempty"`
+	Status              string `json:"Status,omitempty"`
+	Action              string `json:"Action,omitempty"`
+	BOL                 string `json:"BOL,omitempty"`
+	ViewBOL             string `json:"viewbol,omitempty"`
+	BOE                 string `json:"BOE,omitempty"`
+	ViewBOE             string `json:"viewboe,omitempty"`
+	LC                  string `json:"LC,omitempty"`
+	ViewLC              string `json:"viewlc,omitempty"`
+	Invoice             string `json:"Invoice,omitempty"`
+	ViewInvoice         string `json:"viewinvoice,omitempty"`
+	InvoiceStatus       string `json:"InvoiceStatus,omitempty"`
+	PaymentStatus       string `json:"PaymentStatus,omitempty"`
+	LCContractId        string `json:"LCContractId,omitempty"`
+	LCStatus            string `json:"LCStatus,omitempty"`
+	EDStatus            string `json:"EDStatus,omitempty"`
+	Version             int    `json:"Version,omitempty"`
+	Amendments          int    `json:"Amendments,omitempty"`
+	PendingAmendment    int    `json:"PendingAmendment,omitempty"`
+
+	//Payable is set once the importer approves an open-account invoice for payment at maturity
+	Payable *ApprovedPayable `json:"Payable,omitempty"`
+
+	//ScreeningStatus is the sanctions screening status of the PO: CLEAR, SCREENING_HOLD, CLEARED or BLOCKED
+	ScreeningStatus string `json:"ScreeningStatus,omitempty"`
+}
+
+//POLineItem is a single ordered good on a PO. Quantity x UnitPrice must equal Amount.
+type POLineItem struct {
+	LineNo      int
+	Description string
+	Quantity    string
+	Unit        string
+	UnitPrice   string
+	Amount      string
+	HSCode      string `json:"HSCode,omitempty"`
+}
+
+//PO lifecycle states
+const (
+	PO_CREATED              = "CREATED"
+	PO_ACCEPTED_BY_EXPORTER = "ACCEPTED_BY_EXPORTER"
+	PO_LC_REQUESTED         = "LC_REQUESTED"
+	PO_LC_ISSUED            = "LC_ISSUED"
+	PO_SHIPPED              = "SHIPPED"
+	PO_INVOICE_ACCEPTED     = "INVOICE_ACCEPTED"
+	PO_PAID                 = "PAID"
+	PO_CLOSED               = "CLOSED"
+	PO_CANCELLED            = "CANCELLED"
+)
+
+//poTransition is one legal step of the PO lifecycle and the role allowed to take it.
+//LCOnly and OpenAccountOnly restrict the step to POs with IsLCRequired true or not true respectively.
+type poTransition struct {
+	From            string
+	To              string
+	Role            string
+	Action          string
+	LCOnly          bool
+	OpenAccountOnly bool
+}
+
+//poTransitions is the PO lifecycle. Action is the role expected to act next once the step is taken.
+var poTransitions = []poTransition{
+	{From: PO_CREATED, To: PO_ACCEPTED_BY_EXPORTER, Role: "Exporter", Action: "Importer"},
+	{From: PO_CREATED, To: PO_CANCELLED, Role: "Importer"},
+	{From: PO_CREATED, To: PO_CANCELLED, Role: "Exporter"},
+	{From: PO_ACCEPTED_BY_EXPORTER, To: PO_LC_REQUESTED, Role: "Importer", Action: "ImporterBank", LCOnly: true},
+	{From: PO_ACCEPTED_BY_EXPORTER, To: PO_SHIPPED, Role: "ShippingCompany", Action: "Exporter", OpenAccountOnly: true},
+	{From: PO_ACCEPTED_BY_EXPORTER, To: PO_SHIPPED, Role: "Exporter", Action: "Exporter", OpenAccountOnly: true},
+	{From: PO_ACCEPTED_BY_EXPORTER, To: PO_CANCELLED, Role: "Importer"},
+	{From: PO_ACCEPTED_BY_EXPORTER, To: PO_CANCELLED, Role: "Exporter"},
+	{From: PO_LC_REQUESTED, To: PO_LC_ISSUED, Role: "ImporterBank", Action: "ExporterBank", LCOnly: true},
+	{From: PO_LC_REQUESTED, To: PO_CANCELLED, Role: "Importer"},
+	{From: PO_LC_ISSUED, To: PO_SHIPPED, Role: "ShippingCompany", Action: "Exporter", LCOnly: true},
+	{From: PO_LC_ISSUED, To: PO_SHIPPED, Role: "Exporter", Action: "Exporter", LCOnly: true},
+	{From: PO_LC_ISSUED, To: PO_SHIPPED, Role: "ExporterBank", Action: "ImporterBank", LCOnly: true},
+	{From: PO_SHIPPED, To: PO_INVOICE_ACCEPTED, Role: "Importer", Action: "ImporterBank"},
+	{From: PO_SHIPPED, To: PO_INVOICE_ACCEPTED, Role: "ImporterBank", Action: "ImporterBank", LCOnly: true},
+	{From: PO_INVOICE_ACCEPTED, To: PO_PAID, Role: "ImporterBank", Action: "ExporterBank", LCOnly: true},
+	{From: PO_INVOICE_ACCEPTED, To: PO_PAID, Role: "ExporterBank", Action: "Exporter", LCOnly: true},
+	{From: PO_INVOICE_ACCEPTED, To: PO_PAID, Role: "Importer", Action: "Exporter", OpenAccountOnly: true},
+	{From: PO_PAID, To: PO_CLOSED, Role: "Importer"},
+	{From: PO_PAID, To: PO_CLOSED, Role: "Exporter"},
+}
+
+//poLegacyStatus maps the free-text statuses written before the lifecycle existed
+var poLegacyStatus = map[string]string{
+	"":                 PO_CREATED,
+	"LC_Raised":        PO_LC_ISSUED,
+	"Invoice_Created":  PO_SHIPPED,
+	"Invoice_Accepted": PO_INVOICE_ACCEPTED,
 }
 
 //Init initializes the document smart contract
 func (t *PurchaseOrder) Init(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
-	//Place an empty arry
-	stub.PutState(ALL_PO, []byte("[]"))
 	stub.PutState("id", []byte("1"))
 	return nil, nil
 }
@@ -52,15 +171,49 @@ func (t *PurchaseOrder) createPO(stub shim.ChaincodeStubInterface, args []string
 	who := args[1]
 	fmt.Println("new Payload is " + payload)
 	logger.Info(who)
+
+	var po PurchaseOrder
+	err := json.Unmarshal([]byte(payload), &po)
+	if err != nil {
+		return nil, errors.New("Validation failure: \nPayload: not a valid purchase order " + err.Error())
+	}
 	//validate new po
-	valMsg := t.validatePO(who, payload)
-	// for getting uniqueId, this'll give new id per second
-	poNo := time.Now().Local().Format("20060102150405")
+	valMsg := t.validatePO(who, &po)
+	hsMsg, err := hsCodeMessages(stub, poHSLines(&po))
+	if err != nil {
+		return nil, err
+	}
+	valMsg += hsMsg
+	// A PO is encrypted at creation with the key supplied for its number, so the client may choose the number
+	// in the payload. Otherwise this'll give new id per second.
+	poNo := po.ContractId
+	if poNo == "" {
+		poNo = time.Now().Local().Format("20060102150405")
+	} else if _, err := strconv.ParseUint(poNo, 10, 64); err != nil {
+		valMsg += "\nContractId: a PO number must be digits only"
+	}
+	existing, err := stub.GetState(poNo)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil {
+		valMsg += "\nContractId: PO " + poNo + " already exists"
+	}
 	//If there is no error messages then create the UFA
 	if valMsg == "" {
-		stub.PutState(poNo, []byte(payload))
+		po.ContractId = poNo
+		po.Status = PO_CREATED
+		po.Action = "Exporter"
+		po.Version = 1
+		err = screenPO(stub, &po)
+		if err != nil {
+			return nil, err
+		}
+		err = putPO(stub, &po)
+		if err != nil {
+			return nil, err
+		}
 		fmt.Println("new poNo is " + poNo)
-		t.updateMasterRecords(stub, poNo)
 		logger.Info("Created the PO after successful validation : " + payload)
 	} else {
 		return nil, errors.New("Validation failure: " + valMsg)
@@ -69,63 +222,230 @@ func (t *PurchaseOrder) createPO(stub shim.ChaincodeStubInterface, args []string
 }
 
 //Validate a PO
-func (t *PurchaseOrder) validatePO(who string, payload string) string {
+func (t *PurchaseOrder) validatePO(who string, po *PurchaseOrder) string {
 
-	//As of now I am checking if who is of proper role
 	var validationMessage bytes.Buffer
-	var ufaDetails map[string]string
 
 	logger.Info("validateNewPO")
 
 	if who == "Importer" {
-		json.Unmarshal([]byte(payload), &ufaDetails)
-		//		if ufaDetails["Currency"] != "Rs"{
-		//			logger.Info(ufaDetails["Currency"])
-		//			validationMessage.WriteString("\naIncorrect PurchaseOrder")
-		//		}
 		//Now check individual fields
-
+		validationMessage.WriteString(validatePOFields(po))
 	} else {
 		validationMessage.WriteString("\naAccess Denied to create a PO")
 	}
 	logger.Info("Validation messagge " + validationMessage.String())
-	//logger.Info(ufaDetails["Currency"])
 	return validationMessage.String()
 }
 
-//Append a newPO number to the master list
-func (t *PurchaseOrder) updateMasterRecords(stub shim.ChaincodeStubInterface, poNo string) error {
-	var recordList []string
-	recBytes, _ := stub.GetState(ALL_PO)
+//validatePOFields checks the commercial fields of a PO and returns one "\nField: message" line per failure.
+//A PO sent without LineItems is treated as a single line built from Commodity, Quantity, UnitPrice and Amount.
+func validatePOFields(po *PurchaseOrder) string {
+	var validationMessage bytes.Buffer
 
-	err := json.Unmarshal(recBytes, &recordList)
+	//the checks run on the decrypted prices and amounts, so a PO read without its key cannot be validated
+	if isEncrypted(po.Amount) || isEncrypted(po.UnitPrice) {
+		return "\nAmount: PO is encrypted, supply its key to validate it"
+	}
+	for _, item := range po.LineItems {
+		if isEncrypted(item.UnitPrice) || isEncrypted(item.Amount) {
+			return "\nLineItems: PO is encrypted, supply its key to validate it"
+		}
+	}
+	if po.Importer == "" {
+		validationMessage.WriteString("\nImporter: required field not provided")
+	}
+	if po.Exporter == "" {
+		validationMessage.WriteString("\nExporter: required field not provided")
+	}
+	if !isoCurrencyCodes[po.Currency] {
+		validationMessage.WriteString("\nCurrency: " + po.Currency + " is not an ISO 4217 currency code")
+	}
+	if incoterm, _ := parseIncoterm(po.TermsofTrade); incoterm == "" {
+		validationMessage.WriteString("\nTermsofTrade: must start with an Incoterms 2020 rule (EXW, FCA, FAS, FOB, CFR, CIF, CPT, CIP, DAP, DPU, DDP)")
+	}
+
+	if len(po.LineItems) == 0 && po.Quantity != "" {
+		po.LineItems = []POLineItem{{Description: po.Commodity, Quantity: po.Quantity, UnitPrice: po.UnitPrice, Amount: po.Amount}}
+	}
+	if len(po.LineItems) == 0 {
+		validationMessage.WriteString("\nLineItems: at least one line item is required")
+		return validationMessage.String()
+	}
+
+	total := 0.0
+	for i := range po.LineItems {
+		item := &po.LineItems[i]
+		field := "LineItems[" + strconv.Itoa(i) + "]"
+		if item.LineNo == 0 {
+			item.LineNo = i + 1
+		}
+		quantity, err := parseDecimal(item.Quantity)
+		if err != nil || quantity <= 0 {
+			validationMessage.WriteString("\n" + field + ".Quantity: must be a positive number")
+			continue
+		}
+		unitPrice, err := parseDecimal(item.UnitPrice)
+		if err != nil || unitPrice < 0 {
+			validationMessage.WriteString("\n" + field + ".UnitPrice: must be a non-negative number")
+			continue
+		}
+		amount, err := parseDecimal(item.Amount)
+		if err != nil {
+			validationMessage.WriteString("\n" + field + ".Amount: must be a number")
+			continue
+		}
+		if !amountsEqual(quantity*unitPrice, amount) {
+			validationMessage.WriteString(fmt.Sprintf("\n%s.Amount: %s does not equal Quantity x UnitPrice (%.2f)", field, item.Amount, quantity*unitPrice))
+		}
+		total += amount
+	}
+
+	amount, err := parseDecimal(po.Amount)
 	if err != nil {
-		return errors.New("Failed to unmarshal updateMasterReords ")
+		validationMessage.WriteString("\nAmount: must be a number")
+	} else if !amountsEqual(amount, total) {
+		validationMessage.WriteString(fmt.Sprintf("\nAmount: %s does not equal the sum of the line item amounts (%.2f)", po.Amount, total))
+	}
+
+	return validationMessage.String()
+}
+
+//parseIncoterm splits TermsofTrade such as "CIF Rotterdam" into the Incoterms rule and the named place.
+//The rule is empty when the first word is not an Incoterms 2020 rule.
+func parseIncoterm(termsOfTrade string) (string, string) {
+	fields := strings.Fields(termsOfTrade)
+	if len(fields) == 0 || !incoterms2020[strings.ToUpper(fields[0])] {
+		return "", ""
+	}
+	return strings.ToUpper(fields[0]), strings.Join(fields[1:], " ")
+}
+
+//parseDecimal parses an amount or quantity, allowing thousands separators
+func parseDecimal(value string) (float64, error) {
+	return strconv.ParseFloat(strings.Replace(strings.TrimSpace(value), ",", "", -1), 64)
+}
+
+//amountOfPO is the Amount of a PO as a number. An encrypted amount can only be read with the PO key.
+func amountOfPO(po *PurchaseOrder) (float64, error) {
+	if isEncrypted(po.Amount) {
+		return 0, errors.New("PO " + po.ContractId + " holds encrypted data. Supply its key to proceed.")
+	}
+	amount, err := parseDecimal(po.Amount)
+	if err != nil {
+		return 0, errors.New("Amount of PO " + po.ContractId + " is not a number")
+	}
+	return amount, nil
+}
+
+//amountsEqual compares two money amounts to the cent
+func amountsEqual(a float64, b float64) bool {
+	return math.Abs(a-b) < 0.005
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, value := range values {
+		set[value] = true
+	}
+	return set
+}
+
+//poIndexValue returns the value of an indexed PO field
+func poIndexValue(po *PurchaseOrder, field string) string {
+	switch field {
+	case "Importer":
+		return po.Importer
+	case "Exporter":
+		return po.Exporter
+	case "ExporterBank":
+		return po.ExporterBank
+	case "ShippingCompany":
+		return po.ShippingCompany
+	case "Status":
+		return currentPOStatus(po)
+	}
+	return ""
+}
+
+func poIndexKey(field string, value string, poNumber string) string {
+	return PO_INDEX + "~" + field + "~" + value + "~" + poNumber
+}
+
+//poIndexKeys returns the index entries of a PO; empty values are not indexed
+func poIndexKeys(po *PurchaseOrder) map[string]bool {
+	keys := make(map[string]bool)
+	if po == nil {
+		return keys
+	}
+	for _, field := range poIndexFields {
+		value := poIndexValue(po, field)
+		if value != "" || field == "All" {
+			keys[poIndexKey(field, value, po.ContractId)] = true
+		}
+	}
+	return keys
+}
+
+//updatePOIndexes replaces the index entries of the previous version of a PO with those of the new one
+func updatePOIndexes(stub shim.ChaincodeStubInterface, previous *PurchaseOrder, po *PurchaseOrder) error {
+	oldKeys := poIndexKeys(previous)
+	newKeys := poIndexKeys(po)
+	for key := range oldKeys {
+		if !newKeys[key] {
+			err := stub.DelState(key)
+			if err != nil {
+				return errors.New("Failed to delete PO index " + key)
+			}
+		}
+	}
+	for key := range newKeys {
+		if !oldKeys[key] {
+			err := stub.PutState(key, []byte{0})
+			if err != nil {
+				return errors.New("Failed to write PO index " + key)
+			}
+		}
 	}
-	recordList = append(recordList, poNo)
-	bytesToStore, _ := json.Marshal(recordList)
-	logger.Info("After addition" + string(bytesToStore))
-	stub.PutState(ALL_PO, bytesToStore)
 	return nil
 }
 
+//queryPOIndex returns the POs whose indexed field equals value, reading only the matching records
+func queryPOIndex(stub shim.ChaincodeStubInterface, field string, value string) ([]PurchaseOrder, error) {
+	prefix := PO_INDEX + "~" + field + "~" + value + "~"
+	//'\x7f' sorts directly after the '~' that ends the prefix
+	iter, err := stub.RangeQueryState(prefix, prefix[:len(prefix)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query PO index " + field)
+	}
+	defer iter.Close()
+
+	outputRecords := make([]PurchaseOrder, 0)
+	for iter.HasNext() {
+		key, _, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to read PO index " + field)
+		}
+		record, err := getPO(stub, key[len(prefix):])
+		if err != nil {
+			return nil, err
+		}
+		//values containing '~' can share a prefix with another value
+		if record == nil || (field != "All" && poIndexValue(record, field) != value) {
+			continue
+		}
+		outputRecords = append(outputRecords, *record)
+	}
+	return outputRecords, nil
+}
+
 //get all the newPo
 func (t *PurchaseOrder) getAllPo(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getAllPo called")
-	recordsList, err := getAllRecordsList(stub)
+	outputRecords, err := queryPOIndex(stub, "All", "")
 	if err != nil {
 		return nil, errors.New("Unable to get all the records ")
 	}
-	var outputRecords []map[string]string
-	outputRecords = make([]map[string]string, 0)
-	for _, value := range recordsList {
-		recBytes, _ := t.getPoDetails(stub, value)
-
-		var record map[string]string
-		json.Unmarshal(recBytes, &record)
-		record["ContractId"] = value
-		outputRecords = append(outputRecords, record)
-	}
 	outputBytes, _ := json.Marshal(outputRecords)
 	logger.Info("Returning records from getAllPo " + string(outputBytes))
 	return outputBytes, nil
@@ -134,22 +454,13 @@ func (t *PurchaseOrder) getAllPo(stub shim.ChaincodeStubInterface, args []string
 //get all the o for an exporterBank
 func (t *PurchaseOrder) getAllPoForExporterBank(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getAllPoForExporterBank called")
-	recordsList, err := getAllRecordsList(stub)
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	outputRecords, err := queryPOIndex(stub, "ExporterBank", args[0])
 	if err != nil {
 		return nil, errors.New("Unable to get all the records ")
 	}
-	var outputRecords []map[string]string
-	outputRecords = make([]map[string]string, 0)
-	for _, value := range recordsList {
-		recBytes, _ := t.getPoDetails(stub, value)
-
-		var record map[string]string
-		json.Unmarshal(recBytes, &record)
-		record["ContractId"] = value
-		if args[0] == record["ExporterBank"] {
-			outputRecords = append(outputRecords, record)
-		}
-	}
 	outputBytes, _ := json.Marshal(outputRecords)
 	logger.Info("Returning records from getAllPoExporterBank " + string(outputBytes))
 	return outputBytes, nil
@@ -158,38 +469,409 @@ func (t *PurchaseOrder) getAllPoForExporterBank(stub shim.ChaincodeStubInterface
 //get all the o for an exporterBank
 func (t *PurchaseOrder) getAllPoForExporter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 	logger.Info("getAllPoForExporter called")
-	recordsList, err := getAllRecordsList(stub)
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	outputRecords, err := queryPOIndex(stub, "Exporter", args[0])
 	if err != nil {
 		return nil, errors.New("Unable to get all the records ")
 	}
-	var outputRecords []map[string]string
-	outputRecords = make([]map[string]string, 0)
-	for _, value := range recordsList {
-		recBytes, _ := t.getPoDetails(stub, value)
+	outputBytes, _ := json.Marshal(outputRecords)
+	logger.Info("Returning records from getAllPoForExporter " + string(outputBytes))
+	return outputBytes, nil
+}
 
-		var record map[string]string
-		json.Unmarshal(recBytes, &record)
-		record["ContractId"] = value
-		if args[0] == record["Exporter"] {
-			outputRecords = append(outputRecords, record)
-		}
+//get all the po for an importer
+func (t *PurchaseOrder) getAllPoForImporter(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getAllPoForImporter called")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	outputRecords, err := queryPOIndex(stub, "Importer", args[0])
+	if err != nil {
+		return nil, errors.New("Unable to get all the records ")
 	}
 	outputBytes, _ := json.Marshal(outputRecords)
-	logger.Info("Returning records from getAllPoForExporter " + string(outputBytes))
+	logger.Info("Returning records from getAllPoForImporter " + string(outputBytes))
 	return outputBytes, nil
 }
 
-//Returns all the Po Numbers stored
-func getAllRecordsList(stub shim.ChaincodeStubInterface) ([]string, error) {
+//get all the po in a lifecycle state
+func (t *PurchaseOrder) getAllPoByStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("getAllPoByStatus called")
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	outputRecords, err := queryPOIndex(stub, "Status", args[0])
+	if err != nil {
+		return nil, errors.New("Unable to get all the records ")
+	}
+	outputBytes, _ := json.Marshal(outputRecords)
+	logger.Info("Returning records from getAllPoByStatus " + string(outputBytes))
+	return outputBytes, nil
+}
+
+//reindexPOs builds the secondary indexes for the POs listed in the old ALL_PO master list and then removes the list
+func (t *PurchaseOrder) reindexPOs(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("reindexPOs called")
 	var recordList []string
 	recBytes, _ := stub.GetState(ALL_PO)
+	if recBytes == nil {
+		return nil, nil
+	}
 
 	err := json.Unmarshal(recBytes, &recordList)
 	if err != nil {
-		return nil, errors.New("Failed to unmarshal getAllRecordsList ")
+		return nil, errors.New("Failed to unmarshal ALL_PO ")
+	}
+	for _, poNumber := range recordList {
+		po, err := getPO(stub, poNumber)
+		if err != nil {
+			return nil, err
+		}
+		if po == nil {
+			continue
+		}
+		err = updatePOIndexes(stub, nil, po)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return nil, stub.DelState(ALL_PO)
+}
+
+//getPO reads a single PO into the typed model. A nil PO with a nil error means no record exists.
+func getPO(stub shim.ChaincodeStubInterface, poNumber string) (*PurchaseOrder, error) {
+	recBytes, err := stub.GetState(poNumber)
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Failed to get state for " + poNumber + "\"}")
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	recBytes, err = decryptJSONFields(stub, poNumber, recBytes, sensitivePOFields)
+	if err != nil {
+		return nil, err
+	}
+	var po PurchaseOrder
+	err = json.Unmarshal(recBytes, &po)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal getRecord ")
+	}
+	if po.ContractId == "" {
+		po.ContractId = poNumber
+	}
+	return &po, nil
+}
+
+//putPO stores a PO under its ContractId and keeps its secondary indexes up to date
+func putPO(stub shim.ChaincodeStubInterface, po *PurchaseOrder) error {
+	previous, err := getPO(stub, po.ContractId)
+	if err != nil {
+		return err
+	}
+	outputBytes, err := marshalPO(stub, po)
+	if err != nil {
+		return err
+	}
+	err = stub.PutState(po.ContractId, outputBytes)
+	if err != nil {
+		return err
+	}
+	return updatePOIndexes(stub, previous, po)
+}
+
+//marshalPO encodes a PO for the ledger, encrypting its prices and amounts if the caller supplied the PO key
+func marshalPO(stub shim.ChaincodeStubInterface, po *PurchaseOrder) ([]byte, error) {
+	outputBytes, err := json.Marshal(po)
+	if err != nil {
+		return nil, errors.New("Failed to marshal PO " + po.ContractId)
+	}
+	return encryptJSONFields(stub, po.ContractId, outputBytes, sensitivePOFields)
+}
+
+//noPORecord is the response returned when a PO number is unknown
+func noPORecord(poNumber string) []byte {
+	return []byte("{\"Message\":\"No record exists for " + poNumber + "\"}")
+}
+
+//poStates are the states of the PO lifecycle
+var poStates = toSet([]string{PO_CREATED, PO_ACCEPTED_BY_EXPORTER, PO_LC_REQUESTED, PO_LC_ISSUED, PO_SHIPPED,
+	PO_INVOICE_ACCEPTED, PO_PAID, PO_CLOSED, PO_CANCELLED})
+
+//currentPOStatus returns the lifecycle state of a PO, translating statuses written before the lifecycle existed.
+//Those were free text: the ones the old code wrote itself are mapped, any other is worked out from how far the PO got.
+func currentPOStatus(po *PurchaseOrder) string {
+	if poStates[po.Status] {
+		return po.Status
+	}
+	if status, ok := poLegacyStatus[po.Status]; ok {
+		return status
+	}
+	switch {
+	case po.PaymentStatus != "":
+		return PO_PAID
+	case po.InvoiceStatus != "" && po.InvoiceStatus != "Invoice_Created":
+		return PO_INVOICE_ACCEPTED
+	case po.Invoice != "" || po.BOL != "":
+		return PO_SHIPPED
+	case po.LC != "":
+		return PO_LC_ISSUED
+	case po.PORejectReason != "":
+		return PO_CANCELLED
+	case po.ExporterBank != "" || po.IsLCRequired != "":
+		return PO_ACCEPTED_BY_EXPORTER
+	}
+	return PO_CREATED
+}
+
+//errPORoleMissing answers the two-argument calls made before the lifecycle existed. They did not name the
+//caller's role, which every lifecycle step is checked against.
+var errPORoleMissing = errors.New("Incorrect number of arguments. The caller's role is required as the third argument.")
+
+//allowedPOTransitions lists the steps that can be taken from the PO's current state, optionally only those open to who
+func allowedPOTransitions(po *PurchaseOrder, who string) []poTransition {
+	status := currentPOStatus(po)
+	allowed := make([]poTransition, 0)
+	for _, transition := range poTransitions {
+		if transition.From != status || (who != "" && transition.Role != who) {
+			continue
+		}
+		if transition.LCOnly && po.IsLCRequired != "true" {
+			continue
+		}
+		if transition.OpenAccountOnly && po.IsLCRequired == "true" {
+			continue
+		}
+		allowed = append(allowed, transition)
+	}
+	return allowed
+}
+
+//transitionPO moves the PO to newStatus if the lifecycle allows who to take that step, and sets the next Action
+func transitionPO(po *PurchaseOrder, newStatus string, who string) error {
+	for _, transition := range allowedPOTransitions(po, who) {
+		if transition.To == newStatus {
+			po.Status = newStatus
+			po.Action = transition.Action
+			return nil
+		}
+	}
+	return errors.New("PO " + po.ContractId + ": transition from " + currentPOStatus(po) + " to " + newStatus + " is not allowed for " + who)
+}
+
+//requirePOStatus fails unless the PO is in one of the given states
+func requirePOStatus(po *PurchaseOrder, statuses ...string) error {
+	status := currentPOStatus(po)
+	for _, allowed := range statuses {
+		if status == allowed {
+			return nil
+		}
+	}
+	return errors.New("PO " + po.ContractId + " is " + status + "; expected " + strings.Join(statuses, " or "))
+}
+
+//prefillLCFromPO fills the LC fields left blank from the PO, cross-checks the ones provided and
+//runs the LC field validation. It returns the completed LC JSON.
+func prefillLCFromPO(po *PurchaseOrder, lcJSON string) (string, error) {
+	var lc LC
+	err := json.Unmarshal([]byte(lcJSON), &lc)
+	if err != nil {
+		return "", errors.New("Failed to unmarshal LC " + err.Error())
+	}
+
+	var validationMessage bytes.Buffer
+
+	poAmount, err := amountOfPO(po)
+	if err != nil {
+		return "", err
+	}
+	if lc.Tag32B == "" {
+		lc.Tag32B = po.Currency + strings.Replace(fmt.Sprintf("%.2f", poAmount), ".", ",", 1)
+	} else {
+		currency, amount, err := parseTag32B(lc.Tag32B)
+		if err != nil {
+			validationMessage.WriteString("\nTag32B: " + err.Error())
+		} else {
+			if currency != po.Currency {
+				validationMessage.WriteString("\nTag32B: currency " + currency + " does not match PO Currency " + po.Currency)
+			}
+			if !amountsEqual(amount, poAmount) {
+				validationMessage.WriteString(fmt.Sprintf("\nTag32B: amount %.2f does not match PO Amount %s", amount, po.Amount))
+			}
+		}
+	}
+
+	if lc.Tag44E == "" {
+		lc.Tag44E = po.PortofShipment
+	} else if po.PortofShipment != "" && !samePlace(lc.Tag44E, po.PortofShipment) {
+		validationMessage.WriteString("\nTag44E: port of loading " + lc.Tag44E + " does not match PO PortofShipment " + po.PortofShipment)
+	}
+	if lc.Tag44F == "" {
+		lc.Tag44F = po.PortofDischarge
+	} else if po.PortofDischarge != "" && !samePlace(lc.Tag44F, po.PortofDischarge) {
+		validationMessage.WriteString("\nTag44F: port of discharge " + lc.Tag44F + " does not match PO PortofDischarge " + po.PortofDischarge)
+	}
+
+	//TimeofShipment is free text on older POs; it is only compared when it is a date
+	poShipment, poShipmentErr := time.Parse(time_format, po.TimeofShipment)
+	if lc.Tag44C == "" && poShipmentErr == nil {
+		lc.Tag44C = po.TimeofShipment
+	} else if lc.Tag44C != "" && poShipmentErr == nil {
+		lcShipment, err := time.Parse(time_format, lc.Tag44C)
+		if err != nil {
+			validationMessage.WriteString("\nTag44C: incorrect date format. Expecting mm/dd/yyyy")
+		} else if lcShipment.After(poShipment) {
+			validationMessage.WriteString("\nTag44C: latest date of shipment " + lc.Tag44C + " is later than PO TimeofShipment " + po.TimeofShipment)
+		}
+	}
+
+	if lc.Tag45A == "" {
+		descriptions := make([]string, 0)
+		for _, item := range po.LineItems {
+			descriptions = append(descriptions, strings.Join(strings.Fields(item.Quantity+" "+item.Unit+" "+item.Description), " "))
+		}
+		lc.Tag45A = strings.Join(descriptions, "; ")
+	}
+	if lc.Tag50 == "" {
+		lc.Tag50 = po.Importer
+	}
+	if lc.Tag59 == "" {
+		lc.Tag59 = po.Exporter
+	}
+
+	if validationMessage.Len() > 0 {
+		return "", errors.New("LC does not match PO " + po.ContractId + ": " + validationMessage.String())
+	}
+
+	completed, _ := json.Marshal(lc)
+	res, err := lc.ValidateDoc(nil, []string{string(completed)})
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(string(res), "Error") {
+		return "", errors.New(string(res))
+	}
+	return string(completed), nil
+}
+
+//samePlace compares two port or place names ignoring case and surrounding spaces
+func samePlace(a string, b string) bool {
+	return strings.EqualFold(strings.TrimSpace(a), strings.TrimSpace(b))
+}
+
+//prefillLC completes and cross-checks an LC submitted against a PO; the PO must be waiting for its LC
+func (t *PurchaseOrder) prefillLC(stub shim.ChaincodeStubInterface, poNumber string, lcJSON string) (string, error) {
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return "", err
 	}
+	if po == nil {
+		return "", errors.New("No record exists for PO " + poNumber)
+	}
+	err = requirePOStatus(po, PO_LC_REQUESTED)
+	if err != nil {
+		return "", err
+	}
+	return prefillLCFromPO(po, lcJSON)
+}
 
-	return recordList, nil
+//linkLC records that the LC contract UID in BPTable was raised for the PO and moves the PO to LC_ISSUED
+func (t *PurchaseOrder) linkLC(stub shim.ChaincodeStubInterface, poNumber string, UID string, lcJSON string) error {
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return err
+	}
+	if po == nil {
+		return errors.New("No record exists for PO " + poNumber)
+	}
+	err = transitionPO(po, PO_LC_ISSUED, "ImporterBank")
+	if err != nil {
+		return err
+	}
+	po.LC = lcJSON
+	po.ViewLC = "true"
+	po.LCContractId = UID
+	po.LCStatus = "SUBMITTED_BY_IB"
+
+	err = stub.PutState(LC_PO_PREFIX+UID, []byte(poNumber))
+	if err != nil {
+		return err
+	}
+	return putPO(stub, po)
+}
+
+//getLinkedPONumber returns the PO the LC contract UID was raised for, or "" if it is not linked
+func getLinkedPONumber(stub shim.ChaincodeStubInterface, UID string) (string, error) {
+	poNumber, err := stub.GetState(LC_PO_PREFIX + UID)
+	if err != nil {
+		return "", errors.New("{\"Error\":\"Failed to get state for " + LC_PO_PREFIX + UID + "\"}")
+	}
+	return string(poNumber), nil
+}
+
+//recordLCEvent reflects an LC or export-document status change on the linked PO, if any.
+//Empty statuses are left unchanged. poStatus is taken as a lifecycle step for who only when the PO is ready for it.
+func (t *PurchaseOrder) recordLCEvent(stub shim.ChaincodeStubInterface, UID string, lcStatus string, edStatus string, poStatus string, who string) error {
+	poNumber, err := getLinkedPONumber(stub, UID)
+	if err != nil || poNumber == "" {
+		return err
+	}
+	po, err := getPO(stub, poNumber)
+	if err != nil || po == nil {
+		return err
+	}
+	if lcStatus != "" {
+		po.LCStatus = lcStatus
+	}
+	if edStatus != "" {
+		po.EDStatus = edStatus
+	}
+	if poStatus != "" {
+		for _, transition := range allowedPOTransitions(po, who) {
+			if transition.To == poStatus {
+				transitionPO(po, poStatus, who)
+				break
+			}
+		}
+	}
+	logger.Info("LC " + UID + " event recorded on PO " + poNumber)
+	return putPO(stub, po)
+}
+
+//getPOTransitions returns the next legal lifecycle steps of a PO; args are PO number and optionally a role to filter on
+func (t *PurchaseOrder) getPOTransitions(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2.")
+	}
+	poNumber := args[0]
+	who := ""
+	if len(args) == 2 {
+		who = args[1]
+	}
+
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+
+	type nextStep struct {
+		Status string
+		Role   string
+	}
+	type transitions struct {
+		ContractId  string
+		Status      string
+		Transitions []nextStep
+	}
+	result := transitions{ContractId: po.ContractId, Status: currentPOStatus(po), Transitions: make([]nextStep, 0)}
+	for _, transition := range allowedPOTransitions(po, who) {
+		result.Transitions = append(result.Transitions, nextStep{Status: transition.To, Role: transition.Role})
+	}
+	return json.Marshal(result)
 }
 
 //Get a single PO
@@ -204,239 +886,249 @@ func (t *PurchaseOrder) getPoDetails(stub shim.ChaincodeStubInterface, args stri
 		return nil, errors.New(jsonResp)
 	}
 	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
+		return noPORecord(poNumber), nil
 
 	}
 	logger.Info("Returning records from getPODetails " + string(recBytes))
-	return recBytes, nil
+	return decryptJSONFields(stub, poNumber, recBytes, sensitivePOFields)
 }
 
-//accept the LC
+//move the PO to a new lifecycle state; args are PO number, new status and role
 func (t *PurchaseOrder) updatePOStatus(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
 	logger.Info("accpetLc called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+	//the old free-text statuses are taken as the lifecycle state they stand for
+	if status, ok := poLegacyStatus[args[1]]; ok && args[1] != "" {
+		args[1] = status
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
 
-	recBytes, _ := stub.GetState(poNumber)
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getAllRecordsList ")
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+	err = transitionPO(po, args[1], who)
+	if err != nil {
+		return nil, err
 	}
-	po["Status"] = args[1]
-	po["Action"] = "ImporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
 
-	return nil, nil
+	return nil, putPO(stub, po)
 
 }
 
-//update the PO details
+//update the PO details when the exporter accepts or declines a new PO; later changes go through proposePOAmendment
 func (t *PurchaseOrder) updatePODetails(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
-	var jsonResp string
 	logger.Info("updatePO called ")
+	if len(args) != 5 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 5.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
-	if args[4] == "Exporter" {
-		recBytes, err := stub.GetState(poNumber)
+	who := args[4]      //Role
+	if who == "Exporter" {
+		po, err := getPO(stub, poNumber)
 		if err != nil {
-			jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-			return nil, errors.New(jsonResp)
+			return nil, err
+		}
+		if po == nil {
+			return noPORecord(poNumber), nil
+		}
+		err = requirePOStatus(po, PO_CREATED)
+		if err != nil {
+			return nil, err
+		}
+		po.ExporterBank = args[1]
+		po.IsLCRequired = args[2]
+		if args[3] != "" && args[3] != currentPOStatus(po) {
+			err = transitionPO(po, args[3], who)
+			if err != nil {
+				return nil, err
+			}
 		}
-		if recBytes == nil {
-			jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-			return []byte(jsonResp), nil
 
+		//only the fields set here are validated: a PO created before validatePOFields existed, e.g. with
+		//"Rs" as its currency or without an Incoterm, can still be accepted
+		valMsg := ""
+		if po.ExporterBank == "" {
+			valMsg += "\nExporterBank: required field not provided"
 		}
-		newerr := json.Unmarshal(recBytes, &po)
-		if newerr != nil {
-			return nil, errors.New("Failed to unmarshal getRecord ")
+		if po.IsLCRequired != "true" && po.IsLCRequired != "false" {
+			valMsg += "\nIsLCRequired: must be true or false"
 		}
-		po["ExporterBank"] = args[1]
-		po["IsLCRequired"] = args[2]
-		po["Status"] = args[3]
-		po["Action"] = "Importer"
-		outputBytes, _ := json.Marshal(po)
-		stub.PutState(poNumber, outputBytes)
-	} else {
-		return nil, errors.New("Not Authorized to access this service ")
+		if valMsg != "" {
+			return nil, errors.New("Validation failure: " + valMsg)
+		}
+		err = screenPO(stub, po)
+		if err != nil {
+			return nil, err
+		}
+		return nil, putPO(stub, po)
 	}
-	return nil, nil
+	return nil, errors.New("Not Authorized to access this service ")
 
 }
 
-//upload the bol
+//upload the bol; args are PO number, BOL and role
 func (t *PurchaseOrder) uploadBOL(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
-	var jsonResp string
 	logger.Info("updateBOL called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
+	err = transitionPO(po, PO_SHIPPED, who)
+	if err != nil {
+		return nil, err
 	}
-	po["BOL"] = args[1]
-	po["viewbol"] = "true"
-	po["Action"] = "Shipper"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
+	po.BOL = args[1]
+	po.ViewBOL = "true"
 
-	return nil, nil
+	return nil, putPO(stub, po)
 
 }
 
 //upload the boe
 func (t *PurchaseOrder) uploadBOE(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
-	var jsonResp string
 	logger.Info("updateBOE called ")
 
 	poNumber := args[0] //PO num
 	//who :=args[1] //Role
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
+	err = requirePOStatus(po, PO_SHIPPED, PO_INVOICE_ACCEPTED, PO_PAID)
+	if err != nil {
+		return nil, err
 	}
-	po["BOE"] = args[1]
-	po["viewboe"] = "true"
-	po["Action"] = "ImporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
+	po.BOE = args[1]
+	po.ViewBOE = "true"
+	po.Action = "ImporterBank"
 
-	return nil, nil
+	return nil, putPO(stub, po)
 }
 
-//upload the boe
+//upload the LC; args are PO number, LC and role
 func (t *PurchaseOrder) uploadLC(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
-	var jsonResp string
 	logger.Info("uploadLC called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
+	err = transitionPO(po, PO_LC_ISSUED, who)
+	if err != nil {
+		return nil, err
 	}
-	po["LC"] = args[1]
-	po["viewlc"] = "true"
-	po["Status"] = "LC_Raised"
-	po["Action"] = "ExporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
+	lcJSON, err := prefillLCFromPO(po, args[1])
+	if err != nil {
+		return nil, err
+	}
+	po.LC = lcJSON
+	po.ViewLC = "true"
 
-	return nil, nil
+	return nil, putPO(stub, po)
 }
 
-//upload the boe ShippingCompany
+//upload the invoice; args are PO number, invoice and role
 func (t *PurchaseOrder) uploadInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
-	var po map[string]string
-	var jsonResp string
 	logger.Info("uploadInvoice called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
+	if who != "Exporter" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord")
+	err = requirePOStatus(po, PO_ACCEPTED_BY_EXPORTER, PO_LC_ISSUED, PO_SHIPPED)
+	if err != nil {
+		return nil, err
 	}
-	po["Invoice"] = args[1]
-	po["viewinvoice"] = "true"
-	po["Status"] = "Invoice_Created"
-	po["Action"] = "Importer"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
+	po.Invoice = args[1]
+	po.ViewInvoice = "true"
+	po.InvoiceStatus = "Invoice_Created"
+	po.Action = "Importer"
 
-	return nil, nil
+	return nil, putPO(stub, po)
 }
 
 //get all the po for shipping company
 func (t *PurchaseOrder) getAllBOLShippingCompany(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
 
 	logger.Info("getAllPoForExporter called")
-	recordsList, err := getAllRecordsList(stub)
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	records, err := queryPOIndex(stub, "ShippingCompany", args[0])
 	if err != nil {
 		return nil, errors.New("Unable to get all the records ")
 	}
 	var outputRecords []map[string]string
 	outputRecords = make([]map[string]string, 0)
-	for _, value := range recordsList {
-		recBytes, _ := t.getPoDetails(stub, value)
-
-		cid := make(map[string]string)
+	for _, record := range records {
+		if record.BOL != "" {
+			cid := make(map[string]string)
+			cid["ContractId"] = record.ContractId
+			cid["doc"] = record.BOL
 
-		cid["ContractId"] = value
-
-		var record map[string]string
-		json.Unmarshal(recBytes, &record)
-		record["ContractId"] = value
-		if args[0] == record["ShippingCompany"] {
-			if record["BOL"] != "" {
-			
-
-					cid["doc"] = record["BOL"]
-
-				outputRecords = append(outputRecords, cid)
-				
-
-			}
+			outputRecords = append(outputRecords, cid)
 		}
 	}
 	outputBytes, _ := json.Marshal(outputRecords)
@@ -447,30 +1139,25 @@ func (t *PurchaseOrder) getAllBOLShippingCompany(stub shim.ChaincodeStubInterfac
 //get all docs for PO
 func (t *PurchaseOrder) getAllDocsPO(stub shim.ChaincodeStubInterface, args string) ([]byte, error) {
 	logger.Info("getAllDocs called")
-	var jsonResp string
 	var outputRecords []map[string]string
 	outputRecords = make([]map[string]string, 0)
 
-	recBytes, err := t.getPoDetails(stub, args)
+	record, err := getPO(stub, args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + args + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + args + "\"}"
-		return []byte(jsonResp), nil
+	if record == nil {
+		return noPORecord(args), nil
 
 	}
-	var record map[string]string
-	json.Unmarshal(recBytes, &record)
 	var bol map[string]string
-	json.Unmarshal([]byte(record["BOL"]), &bol)
+	json.Unmarshal([]byte(record.BOL), &bol)
 	outputRecords = append(outputRecords, bol)
 	var boe map[string]string
-	json.Unmarshal([]byte(record["BOE"]), &boe)
+	json.Unmarshal([]byte(record.BOE), &boe)
 	outputRecords = append(outputRecords, boe)
 	var invoice map[string]string
-	json.Unmarshal([]byte(record["Invoice"]), &invoice)
+	json.Unmarshal([]byte(record.Invoice), &invoice)
 	outputRecords = append(outputRecords, invoice)
 
 	outputBytes, _ := json.Marshal(outputRecords)
@@ -481,23 +1168,18 @@ func (t *PurchaseOrder) getAllDocsPO(stub shim.ChaincodeStubInterface, args stri
 //get all invoice
 func (t *PurchaseOrder) getInvoice(stub shim.ChaincodeStubInterface, args string) ([]byte, error) {
 	logger.Info("getInvoice called")
-	var jsonResp string
 
-	recBytes, err := t.getPoDetails(stub, args)
+	record, err := getPO(stub, args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + args + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + args + "\"}"
-		return []byte(jsonResp), nil
+	if record == nil {
+		return noPORecord(args), nil
 
 	}
-	var record map[string]string
-	json.Unmarshal(recBytes, &record)
 
 	var invoice map[string]string
-	json.Unmarshal([]byte(record["Invoice"]), &invoice)
+	json.Unmarshal([]byte(record.Invoice), &invoice)
 
 	outputBytes, _ := json.Marshal(invoice)
 
@@ -508,22 +1190,17 @@ func (t *PurchaseOrder) getInvoice(stub shim.ChaincodeStubInterface, args string
 //get LC
 func (t *PurchaseOrder) getLC(stub shim.ChaincodeStubInterface, args string) ([]byte, error) {
 	logger.Info("getLC called")
-	var jsonResp string
-	recBytes, err := t.getPoDetails(stub, args)
+	record, err := getPO(stub, args)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + args + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + args + "\"}"
-		return []byte(jsonResp), nil
+	if record == nil {
+		return noPORecord(args), nil
 
 	}
-	var record map[string]string
-	json.Unmarshal(recBytes, &record)
 
 	var lc map[string]string
-	json.Unmarshal([]byte(record["LC"]), &lc)
+	json.Unmarshal([]byte(record.LC), &lc)
 
 	outputBytes, _ := json.Marshal(lc)
 
@@ -531,97 +1208,89 @@ func (t *PurchaseOrder) getLC(stub shim.ChaincodeStubInterface, args string) ([]
 	return outputBytes, nil
 }
 
-//change po status
+//change po status; args are PO number, new status and role
 func (t *PurchaseOrder) acceptClass(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var po map[string]string
-	var jsonResp string
 	logger.Info("postatus called ")
 
-	poNumber := args[0] //PO num
-	//who :=args[1] //Role
-
-	recBytes, err := stub.GetState(poNumber)
-	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
-	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
-	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
-	}
-
-	po["Status"] = args[1]
-	po["Action"] = "ImporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
-	return nil, nil
+	return t.updatePOStatus(stub, args)
 }
 
-//accept Invoice
+//accept Invoice; args are PO number, invoice status, role and, for open-account POs, an optional
+//maturity date at which the importer irrevocably undertakes to pay the invoice
 func (t *PurchaseOrder) acceptInvoice(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var po map[string]string
-	var jsonResp string
 	logger.Info("acceptInvoice called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 or 4.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
+	if po.Invoice == "" {
+		return nil, errors.New("No invoice has been uploaded for PO " + poNumber)
+	}
+	err = transitionPO(po, PO_INVOICE_ACCEPTED, who)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 4 && args[3] != "" {
+		err = approvePayable(stub, po, args[3])
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	po["InvoiceStatus"] = args[1]
-	po["Status"] = "Invoice_Accepted"
-	po["Action"] = "ImporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
-	return nil, nil
+	po.InvoiceStatus = args[1]
+	return nil, putPO(stub, po)
 }
 
-//acceptPayment
+//acceptPayment; args are PO number, payment status and role
 func (t *PurchaseOrder) acceptPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
-	var po map[string]string
-	var jsonResp string
 	logger.Info("acceptPayment called ")
+	if len(args) == 2 {
+		return nil, errPORoleMissing
+	}
+	if len(args) != 3 && len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3 or 4.")
+	}
 
 	poNumber := args[0] //PO num
-	//who :=args[1] //Role
+	who := args[2]      //Role
 
-	recBytes, err := stub.GetState(poNumber)
+	po, err := getPO(stub, poNumber)
 	if err != nil {
-		jsonResp = "{\"Error\":\"Failed to get state for " + poNumber + "\"}"
-		return nil, errors.New(jsonResp)
+		return nil, err
 	}
-	if recBytes == nil {
-		jsonResp = "{\"Message\":\"No record exists for " + poNumber + "\"}"
-		return []byte(jsonResp), nil
-
+	if po == nil {
+		return noPORecord(poNumber), nil
 	}
-	newerr := json.Unmarshal(recBytes, &po)
-	if newerr != nil {
-		return nil, errors.New("Failed to unmarshal getRecord ")
+	//check the PO can be paid before booking anything against it
+	paid := *po
+	err = transitionPO(&paid, PO_PAID, who)
+	if err != nil {
+		return nil, err
 	}
 
-	po["PaymentStatus"] = args[1]
-	po["Status"] = args[1]
-	po["Action"] = "ExporterBank"
-	outputBytes, _ := json.Marshal(po)
-	stub.PutState(poNumber, outputBytes)
-	return nil, nil
+	//an optional payment JSON records a part payment; the PO is paid once the balance is settled
+	settlement, err := t.recordPOPayment(stub, po, args)
+	if err != nil {
+		return nil, err
+	}
+	if settlement.Status != SETTLEMENT_SETTLED {
+		po.PaymentStatus = SETTLEMENT_PARTIAL
+		return nil, putPO(stub, po)
+	}
+	paid.PaymentStatus = args[1]
+	settlePayable(&paid)
+	return nil, putPO(stub, &paid)
 }
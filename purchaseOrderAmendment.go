@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+//PO amendment states
+const (
+	AMENDMENT_PROPOSED = "PROPOSED"
+	AMENDMENT_APPROVED = "APPROVED"
+	AMENDMENT_REJECTED = "REJECTED"
+)
+
+//amendablePOFields are the PO fields an amendment may change
+var amendablePOFields = toSet([]string{"Commodity", "Currency", "UnitPrice", "Amount", "Quantity", "Weight", "LineItems",
+	"TermsofPayment", "TermsofTrade", "TermsofInsurance", "PackingMethod", "WayofTransportation", "TimeofShipment",
+	"PortofShipment", "PortofDischarge", "PaymentDate", "ImporterBank", "ExporterBank", "ShippingCompany",
+	"InsuranceCompany", "IsLCRequired"})
+
+//amendablePOStatuses are the states in which an amendment may be proposed or approved
+var amendablePOStatuses = []string{PO_CREATED, PO_ACCEPTED_BY_EXPORTER, PO_LC_REQUESTED, PO_LC_ISSUED, PO_SHIPPED, PO_INVOICE_ACCEPTED}
+
+//POAmendment is a change to PO fields proposed by one trading party and approved or rejected by the other
+type POAmendment struct {
+	ContractId  string
+	AmendmentNo int
+	BaseVersion int
+	Changes     json.RawMessage
+	ProposedBy  string
+	Reason      string
+	Status      string
+	DecidedBy   string `json:"DecidedBy,omitempty"`
+	Comment     string `json:"Comment,omitempty"`
+	Version     int    `json:"Version,omitempty"`
+}
+
+func poAmendmentKey(poNumber string, amendmentNo int) string {
+	return fmt.Sprintf("POA_%s_%04d", poNumber, amendmentNo)
+}
+
+func poVersionKey(poNumber string, version int) string {
+	return fmt.Sprintf("POV_%s_%04d", poNumber, version)
+}
+
+//currentPOVersion returns the version of a PO; POs created before versioning are version 1
+func currentPOVersion(po *PurchaseOrder) int {
+	if po.Version == 0 {
+		return 1
+	}
+	return po.Version
+}
+
+//counterparty returns the trading party that must approve an amendment proposed by who
+func counterparty(who string) (string, error) {
+	if who == "Importer" {
+		return "Exporter", nil
+	} else if who == "Exporter" {
+		return "Importer", nil
+	}
+	return "", errors.New("Only the Importer or Exporter can amend a PO")
+}
+
+//applyPOChanges returns a copy of the PO with the changes applied. Only amendable fields may be changed.
+func applyPOChanges(po *PurchaseOrder, changes []byte) (*PurchaseOrder, error) {
+	var fields map[string]json.RawMessage
+	err := json.Unmarshal(changes, &fields)
+	if err != nil {
+		return nil, errors.New("Amendment changes should be a JSON object " + err.Error())
+	}
+	if len(fields) == 0 {
+		return nil, errors.New("Amendment changes no fields")
+	}
+	for field := range fields {
+		if !amendablePOFields[field] {
+			return nil, errors.New("Field " + field + " cannot be amended")
+		}
+	}
+
+	amended := *po
+	_, lineItemsChanged := fields["LineItems"]
+	_, quantityChanged := fields["Quantity"]
+	_, unitPriceChanged := fields["UnitPrice"]
+	if !lineItemsChanged && (quantityChanged || unitPriceChanged) {
+		//a single-line PO is re-derived from the header; a multi-line PO must amend its LineItems
+		if len(po.LineItems) > 1 {
+			return nil, errors.New("LineItems must be amended together with Quantity or UnitPrice on a PO with several line items")
+		}
+		lineItemsChanged = true
+	}
+	//LineItems are replaced as a whole; drop the old ones so they are not merged element by element
+	if lineItemsChanged {
+		amended.LineItems = nil
+	}
+	err = json.Unmarshal(changes, &amended)
+	if err != nil {
+		return nil, errors.New("Failed to apply amendment changes " + err.Error())
+	}
+	return &amended, nil
+}
+
+//getPOAmendment reads one amendment of a PO
+func getPOAmendment(stub shim.ChaincodeStubInterface, poNumber string, amendmentNo int) (*POAmendment, error) {
+	recBytes, err := stub.GetState(poAmendmentKey(poNumber, amendmentNo))
+	if err != nil {
+		return nil, errors.New("{\"Error\":\"Failed to get state for " + poAmendmentKey(poNumber, amendmentNo) + "\"}")
+	}
+	if recBytes == nil {
+		return nil, errors.New("No amendment " + strconv.Itoa(amendmentNo) + " exists for PO " + poNumber)
+	}
+	var amendment POAmendment
+	err = json.Unmarshal(recBytes, &amendment)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal amendment " + poAmendmentKey(poNumber, amendmentNo))
+	}
+	//changes to prices and amounts are encrypted like the PO itself
+	amendment.Changes, err = decryptJSONFields(stub, poNumber, amendment.Changes, sensitivePOFields)
+	if err != nil {
+		return nil, err
+	}
+	return &amendment, nil
+}
+
+func putPOAmendment(stub shim.ChaincodeStubInterface, amendment *POAmendment) error {
+	stored := *amendment
+	changes, err := encryptJSONFields(stub, amendment.ContractId, amendment.Changes, sensitivePOFields)
+	if err != nil {
+		return err
+	}
+	stored.Changes = changes
+	outputBytes, _ := json.Marshal(stored)
+	return stub.PutState(poAmendmentKey(amendment.ContractId, amendment.AmendmentNo), outputBytes)
+}
+
+//requireNoPayable refuses to amend a PO once the importer has approved its invoice as a payable
+func requireNoPayable(po *PurchaseOrder) error {
+	if po.Payable != nil {
+		return errors.New("PO " + po.ContractId + " cannot be amended: its invoice has been approved for payment at maturity")
+	}
+	return nil
+}
+
+//requireLCTermsUnchanged refuses an amendment that changes what an LC raised for the PO was issued on.
+//Those terms are changed by amending the LC, not the PO.
+func requireLCTermsUnchanged(po *PurchaseOrder, amended *PurchaseOrder) error {
+	if po.LC == "" && po.LCContractId == "" {
+		return nil
+	}
+	//the goods, ports and shipment date are what prefillLCFromPO checked the LC against
+	lineItems, _ := json.Marshal(po.LineItems)
+	amendedLineItems, _ := json.Marshal(amended.LineItems)
+	lcTerms := []struct{ field, was, is string }{
+		{"Amount", po.Amount, amended.Amount},
+		{"Currency", po.Currency, amended.Currency},
+		{"IsLCRequired", po.IsLCRequired, amended.IsLCRequired},
+		{"ImporterBank", po.ImporterBank, amended.ImporterBank},
+		{"ExporterBank", po.ExporterBank, amended.ExporterBank},
+		{"PortofShipment", po.PortofShipment, amended.PortofShipment},
+		{"PortofDischarge", po.PortofDischarge, amended.PortofDischarge},
+		{"TimeofShipment", po.TimeofShipment, amended.TimeofShipment},
+		{"Commodity", po.Commodity, amended.Commodity},
+		{"Quantity", po.Quantity, amended.Quantity},
+		{"LineItems", string(lineItems), string(amendedLineItems)},
+	}
+	for _, term := range lcTerms {
+		if term.was != term.is {
+			return errors.New(term.field + " of PO " + po.ContractId + " cannot be amended: an LC has been raised for it")
+		}
+	}
+	return nil
+}
+
+//proposePOAmendment records a change to a PO for the counterparty to approve; args are PO number, changes JSON, role and reason
+func (t *PurchaseOrder) proposePOAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("proposePOAmendment called ")
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	poNumber := args[0]
+	changes := []byte(args[1])
+	who := args[2]
+	reason := args[3]
+
+	_, err := counterparty(who)
+	if err != nil {
+		return nil, err
+	}
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+	err = requirePOStatus(po, amendablePOStatuses...)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoPayable(po)
+	if err != nil {
+		return nil, err
+	}
+	if po.PendingAmendment != 0 {
+		return nil, errors.New("PO " + poNumber + " already has amendment " + strconv.Itoa(po.PendingAmendment) + " awaiting a decision")
+	}
+
+	amended, err := applyPOChanges(po, changes)
+	if err != nil {
+		return nil, err
+	}
+	err = requireLCTermsUnchanged(po, amended)
+	if err != nil {
+		return nil, err
+	}
+	valMsg := validatePOFields(amended)
+	hsMsg, err := hsCodeMessages(stub, poHSLines(amended))
+	if err != nil {
+		return nil, err
+	}
+	valMsg += hsMsg
+	if valMsg != "" {
+		return nil, errors.New("Validation failure: " + valMsg)
+	}
+
+	amendment := POAmendment{
+		ContractId:  poNumber,
+		AmendmentNo: po.Amendments + 1,
+		BaseVersion: currentPOVersion(po),
+		Changes:     json.RawMessage(changes),
+		ProposedBy:  who,
+		Reason:      reason,
+		Status:      AMENDMENT_PROPOSED,
+	}
+	err = putPOAmendment(stub, &amendment)
+	if err != nil {
+		return nil, err
+	}
+
+	po.Amendments = amendment.AmendmentNo
+	po.PendingAmendment = amendment.AmendmentNo
+	err = putPO(stub, po)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amendment)
+}
+
+//approvePOAmendment applies a proposed amendment as a new PO version; args are PO number, amendment number and role
+func (t *PurchaseOrder) approvePOAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("approvePOAmendment called ")
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	po, amendment, err := t.pendingPOAmendment(stub, args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+	//the PO may have been paid, closed or cancelled since the amendment was proposed
+	err = requirePOStatus(po, amendablePOStatuses...)
+	if err != nil {
+		return nil, err
+	}
+	err = requireNoPayable(po)
+	if err != nil {
+		return nil, err
+	}
+	if amendment.BaseVersion != currentPOVersion(po) {
+		return nil, errors.New("Amendment " + args[1] + " was proposed against version " + strconv.Itoa(amendment.BaseVersion) + " of PO " + args[0])
+	}
+
+	amended, err := applyPOChanges(po, amendment.Changes)
+	if err != nil {
+		return nil, err
+	}
+	err = requireLCTermsUnchanged(po, amended)
+	if err != nil {
+		return nil, err
+	}
+	valMsg := validatePOFields(amended)
+	hsMsg, err := hsCodeMessages(stub, poHSLines(amended))
+	if err != nil {
+		return nil, err
+	}
+	valMsg += hsMsg
+	if valMsg != "" {
+		return nil, errors.New("Validation failure: " + valMsg)
+	}
+
+	//keep the superseded version so it can still be read with getPoDetails
+	previous, err := marshalPO(stub, po)
+	if err != nil {
+		return nil, err
+	}
+	err = stub.PutState(poVersionKey(po.ContractId, currentPOVersion(po)), previous)
+	if err != nil {
+		return nil, err
+	}
+
+	amended.Version = currentPOVersion(po) + 1
+	amended.PendingAmendment = 0
+	// amended parties and ports are screened again
+	err = screenPO(stub, amended)
+	if err != nil {
+		return nil, err
+	}
+	err = putPO(stub, amended)
+	if err != nil {
+		return nil, err
+	}
+
+	amendment.Status = AMENDMENT_APPROVED
+	amendment.DecidedBy = args[2]
+	amendment.Version = amended.Version
+	err = putPOAmendment(stub, amendment)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amendment)
+}
+
+//rejectPOAmendment declines a proposed amendment; args are PO number, amendment number, role and reason
+func (t *PurchaseOrder) rejectPOAmendment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("rejectPOAmendment called ")
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	po, amendment, err := t.pendingPOAmendment(stub, args[0], args[1], args[2])
+	if err != nil {
+		return nil, err
+	}
+
+	po.PendingAmendment = 0
+	err = putPO(stub, po)
+	if err != nil {
+		return nil, err
+	}
+
+	amendment.Status = AMENDMENT_REJECTED
+	amendment.DecidedBy = args[2]
+	amendment.Comment = args[3]
+	err = putPOAmendment(stub, amendment)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(amendment)
+}
+
+//pendingPOAmendment loads a PO and its pending amendment and checks that who is the party that must decide on it
+func (t *PurchaseOrder) pendingPOAmendment(stub shim.ChaincodeStubInterface, poNumber string, amendmentNoStr string, who string) (*PurchaseOrder, *POAmendment, error) {
+	amendmentNo, err := strconv.Atoi(amendmentNoStr)
+	if err != nil {
+		return nil, nil, errors.New("Amendment number should be an integer; " + amendmentNoStr)
+	}
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, nil, err
+	}
+	if po == nil {
+		return nil, nil, errors.New("No record exists for PO " + poNumber)
+	}
+	amendment, err := getPOAmendment(stub, poNumber, amendmentNo)
+	if err != nil {
+		return nil, nil, err
+	}
+	if amendment.Status != AMENDMENT_PROPOSED || po.PendingAmendment != amendmentNo {
+		return nil, nil, errors.New("Amendment " + amendmentNoStr + " of PO " + poNumber + " is " + amendment.Status)
+	}
+	approver, _ := counterparty(amendment.ProposedBy)
+	if who != approver {
+		return nil, nil, errors.New("Amendment " + amendmentNoStr + " of PO " + poNumber + " can only be decided by the " + approver)
+	}
+	return po, amendment, nil
+}
+
+//getPOVersion returns a PO as it was at the given version
+func (t *PurchaseOrder) getPOVersion(stub shim.ChaincodeStubInterface, poNumber string, versionStr string) ([]byte, error) {
+	logger.Info("getPOVersion called with PO number: " + poNumber + " version: " + versionStr)
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return nil, errors.New("Version should be an integer; " + versionStr)
+	}
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+	if version == currentPOVersion(po) {
+		return json.Marshal(po)
+	}
+	if version < 1 || version > currentPOVersion(po) {
+		return nil, errors.New("PO " + poNumber + " has no version " + versionStr)
+	}
+	recBytes, err := stub.GetState(poVersionKey(poNumber, version))
+	if err != nil {
+		return nil, err
+	}
+	return decryptJSONFields(stub, poNumber, recBytes, sensitivePOFields)
+}
+
+//getPOAmendments lists all amendments proposed for a PO
+func (t *PurchaseOrder) getPOAmendments(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	po, err := getPO(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(args[0]), nil
+	}
+	amendments := make([]POAmendment, 0)
+	for i := 1; i <= po.Amendments; i++ {
+		amendment, err := getPOAmendment(stub, args[0], i)
+		if err != nil {
+			return nil, err
+		}
+		amendments = append(amendments, *amendment)
+	}
+	return json.Marshal(amendments)
+}
@@ -0,0 +1,445 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// REIMBURSEMENT prefixes the reimbursement arrangement of an LC: REIMBURSEMENT + UID
+const REIMBURSEMENT = "REIMB~"
+
+// Reimbursement claim states
+const (
+	CLAIM_PENDING  = "CLAIMED"
+	CLAIM_HONOURED = "HONOURED"
+	CLAIM_REJECTED = "REJECTED"
+)
+
+// ReimbursementAuthorisation is the MT740 the issuing bank sends the reimbursing bank
+type ReimbursementAuthorisation struct {
+	Tag20  string //Documentary Credit Number
+	Tag25  string //Account Identification
+	Tag31D string //Date and Place of Expiry
+	Tag58A string //Negotiating Bank
+	Tag59  string //Beneficiary
+	Tag32B string //Currency Code, Credit Amount
+	Tag39A string //Percentage Credit Amount Tolerance
+	Tag41A string //Available with… by…
+	Tag42C string //Drafts at
+	Tag71A string //Reimbursing Bank's Charges - OUR or CLM
+	Tag71D string //Other Charges
+	Tag72Z string //Sender to Receiver Information
+}
+
+// ReimbursementClaim is an MT742 from the claiming bank with how the reimbursing bank decided it
+type ReimbursementClaim struct {
+	Tag20  string //Claiming Bank's Reference
+	Tag21  string //Documentary Credit Number
+	Tag31C string //Date of Issue
+	Tag52A string //Issuing Bank
+	Tag32B string //Currency Code, Principal Amount Claimed
+	Tag33B string //Currency Code, Additional Amount Claimed
+	Tag71D string //Charges
+	Tag34A string //Value Date, Currency Code, Total Amount Claimed
+	Tag57A string //Account With Bank
+	Tag58A string //Beneficiary Bank
+	Tag72Z string //Sender to Receiver Information
+
+	ClaimNo   int
+	Principal float64
+	ValueDate string
+	Status    string
+	Reason    string
+	ClaimedOn string
+	DecidedOn string
+}
+
+// Reimbursement is the reimbursing bank arrangement of an LC with the claims made under it
+type Reimbursement struct {
+	ContractID          string
+	ReimbursingBank     string
+	ReimbursingBankCert []byte
+	Authorisation       ReimbursementAuthorisation
+	Currency            string
+	Authorised          float64 // credit amount plus the upper tolerance
+	Honoured            float64
+	Claims              []ReimbursementClaim
+}
+
+func getReimbursement(stub shim.ChaincodeStubInterface, UID string) (*Reimbursement, error) {
+	recBytes, err := stub.GetState(REIMBURSEMENT + UID)
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + REIMBURSEMENT + UID)
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var record Reimbursement
+	err = json.Unmarshal(recBytes, &record)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal reimbursement of " + UID)
+	}
+	return &record, nil
+}
+
+func mustGetReimbursement(stub shim.ChaincodeStubInterface, UID string) (*Reimbursement, error) {
+	record, err := getReimbursement(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		return nil, errors.New("No reimbursement has been authorised for " + UID)
+	}
+	return record, nil
+}
+
+func putReimbursement(stub shim.ChaincodeStubInterface, record *Reimbursement) error {
+	recBytes, _ := json.Marshal(record)
+	return stub.PutState(REIMBURSEMENT+record.ContractID, recBytes)
+}
+
+// upperTolerance reads the plus percentage of Tag39A such as "10/10"
+func upperTolerance(tag39A string) (float64, error) {
+	if tag39A == "" {
+		return 0, nil
+	}
+	tolerance, err := strconv.Atoi(strings.Split(tag39A, "/")[0])
+	if err != nil || tolerance < 0 || tolerance > 100 {
+		return 0, errors.New("Tag39A should give the tolerance as a percentage such as 10/10")
+	}
+	return float64(tolerance), nil
+}
+
+// parseTag34A splits Tag34A such as "170801USD1000,00" into the value date, currency code and amount
+func parseTag34A(tag34A string) (time.Time, string, float64, error) {
+	if len(tag34A) < 7 {
+		return time.Time{}, "", 0, errors.New("Tag34A should give the value date as YYMMDD followed by the currency and amount")
+	}
+	valueDate, err := time.Parse("060102", tag34A[:6])
+	if err != nil {
+		return time.Time{}, "", 0, errors.New("Tag34A should give the value date as YYMMDD followed by the currency and amount")
+	}
+	currency, amount, err := parseTag32B(tag34A[6:])
+	return valueDate, currency, amount, err
+}
+
+// claimableBalance returns what is still to be paid under an LC: the outstanding balance of its settlement or,
+// before the LC falls due, the amount the settlement will be opened for
+func (t *TF) claimableBalance(stub shim.ChaincodeStubInterface, UID string) (float64, error) {
+	settlement, err := getSettlement(stub, "LC", UID)
+	if err != nil {
+		return 0, err
+	}
+	if settlement != nil {
+		return settlement.Outstanding, nil
+	}
+	_, amount, err := t.contractAmount(stub, UID)
+	return amount, err
+}
+
+// isCallerReimbursingBank checks the caller against the certificate given when reimbursement was authorised
+func (t *TF) isCallerReimbursingBank(stub shim.ChaincodeStubInterface, args []string) (bool, error) {
+	if len(args) != 1 {
+		return false, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := mustGetReimbursement(stub, args[0])
+	if err != nil {
+		return false, err
+	}
+	ok, err := t.isCaller(stub, record.ReimbursingBankCert)
+	if err != nil {
+		return false, errors.New("Failed checking reimbursing bank's identity " + err.Error())
+	}
+	return ok, nil
+}
+
+// authoriseReimbursement records the MT740 authorising a reimbursing bank to honour claims under an LC.
+// args: UID, reimbursing bank (defaults to Tag53A of the LC), reimbursing bank certificate, MT740 JSON
+func (t *TF) authoriseReimbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	UID := args[0]
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) == "PAYMENT_RECEIVED" || string(status) == "PAYMENT_DEFAULTED" || string(status) == "REJECTED_BY_EB" {
+		return nil, errors.New("Reimbursement cannot be authorised for an LC that is " + string(status))
+	}
+	existing, err := getReimbursement(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if existing != nil && len(existing.Claims) > 0 {
+		return nil, errors.New("Claims have already been made under the reimbursement authorisation of " + UID)
+	}
+
+	lcJSON, err := t.lc.GetJSON(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	err = requireDecrypted(UID, lcJSON)
+	if err != nil {
+		return nil, err
+	}
+	var lc LC
+	err = json.Unmarshal(lcJSON, &lc)
+	if err != nil {
+		return nil, err
+	}
+
+	var authorisation ReimbursementAuthorisation
+	err = json.Unmarshal([]byte(args[3]), &authorisation)
+	if err != nil {
+		return nil, errors.New("Reimbursement authorisation should be a JSON object " + err.Error())
+	}
+	if authorisation.Tag20 != lc.Tag20 {
+		return nil, errors.New("Tag20 of the authorisation does not match the documentary credit number " + lc.Tag20)
+	}
+	if _, err = tag31DDate(authorisation.Tag31D); err != nil {
+		return nil, errors.New("Tag31D should start with the expiry date as mm/dd/yyyy")
+	}
+	if authorisation.Tag71A != "" && authorisation.Tag71A != "OUR" && authorisation.Tag71A != "CLM" {
+		return nil, errors.New("Tag71A should be OUR or CLM")
+	}
+	currency, amount, err := parseTag32B(authorisation.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	lcCurrency, lcAmount, err := parseTag32B(lc.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	if currency != lcCurrency || amount > lcAmount {
+		return nil, errors.New("Tag32B of the authorisation should not exceed the credit amount " + lc.Tag32B)
+	}
+	tolerance, err := upperTolerance(authorisation.Tag39A)
+	if err != nil {
+		return nil, err
+	}
+
+	reimbursingBank := args[1]
+	if reimbursingBank == "" {
+		reimbursingBank = lc.Tag53A
+	}
+	if reimbursingBank == "" {
+		return nil, errors.New("Reimbursing bank: required field not provided")
+	}
+	if lc.Tag53A != "" && reimbursingBank != lc.Tag53A {
+		return nil, errors.New("The LC names " + lc.Tag53A + " as reimbursing bank in Tag53A")
+	}
+
+	record := Reimbursement{
+		ContractID:          UID,
+		ReimbursingBank:     reimbursingBank,
+		ReimbursingBankCert: []byte(args[2]),
+		Authorisation:       authorisation,
+		Currency:            currency,
+		Authorised:          amount * (1 + tolerance/100),
+		Claims:              make([]ReimbursementClaim, 0),
+	}
+	return nil, putReimbursement(stub, &record)
+}
+
+// claimReimbursement records an MT742 claim by the negotiating bank; args: UID, MT742 JSON
+func (t *TF) claimReimbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+
+	UID := args[0]
+	record, err := mustGetReimbursement(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) != "ACCEPTED_BY_EB" && string(status) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+		return nil, errors.New("Reimbursement cannot be claimed under an LC that is " + string(status))
+	}
+
+	var claim ReimbursementClaim
+	err = json.Unmarshal([]byte(args[1]), &claim)
+	if err != nil {
+		return nil, errors.New("Reimbursement claim should be a JSON object " + err.Error())
+	}
+	if claim.Tag20 == "" {
+		return nil, errors.New("Tag20: required field not provided")
+	}
+	if claim.Tag21 != record.Authorisation.Tag20 {
+		return nil, errors.New("Tag21 of the claim does not match the documentary credit number " + record.Authorisation.Tag20)
+	}
+	for _, existing := range record.Claims {
+		if existing.Tag20 == claim.Tag20 {
+			return nil, errors.New("Claim " + claim.Tag20 + " has already been made")
+		}
+	}
+
+	currency, principal, err := parseTag32B(claim.Tag32B)
+	if err != nil {
+		return nil, err
+	}
+	total := principal
+	if claim.Tag33B != "" {
+		additionalCurrency, additional, err := parseTag32B(claim.Tag33B)
+		if err != nil {
+			return nil, err
+		}
+		if additionalCurrency != currency {
+			return nil, errors.New("Tag33B should be in the currency of Tag32B")
+		}
+		total += additional
+	}
+	valueDate, totalCurrency, claimedTotal, err := parseTag34A(claim.Tag34A)
+	if err != nil {
+		return nil, err
+	}
+	if currency != record.Currency || totalCurrency != currency {
+		return nil, errors.New("Claims should be made in " + record.Currency)
+	}
+	if math.Abs(claimedTotal-total) > 0.005 {
+		return nil, fmt.Errorf("Tag34A total of %.2f does not equal Tag32B plus Tag33B, %.2f", claimedTotal, total)
+	}
+
+	pending := 0.0
+	for _, existing := range record.Claims {
+		if existing.Status == CLAIM_PENDING {
+			pending += existing.Principal
+		}
+	}
+	if record.Honoured+pending+principal > record.Authorised+0.005 {
+		return nil, fmt.Errorf("Claims of %.2f would exceed the authorised %.2f", record.Honoured+pending+principal, record.Authorised)
+	}
+	balance, err := t.claimableBalance(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if pending+principal > balance+0.005 {
+		return nil, fmt.Errorf("Claims of %.2f would exceed the outstanding balance of %.2f", pending+principal, balance)
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	expiry, _ := tag31DDate(record.Authorisation.Tag31D)
+	if now.After(expiry.AddDate(0, 0, 1)) {
+		return nil, errors.New("The reimbursement authorisation expired on " + expiry.Format(time_format))
+	}
+
+	claim.ClaimNo = len(record.Claims) + 1
+	claim.Principal = principal
+	claim.ValueDate = valueDate.Format(time_format)
+	claim.Status = CLAIM_PENDING
+	claim.ClaimedOn = now.Format(time_format)
+	record.Claims = append(record.Claims, claim)
+	return nil, putReimbursement(stub, record)
+}
+
+// decideReimbursementClaim honours or rejects a claim. A claim can be honoured once the export documents
+// are accepted; it makes the LC payment due and pays its principal against the settlement. args: UID, claim number, HONOURED|REJECTED, reason
+func (t *TF) decideReimbursementClaim(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	UID := args[0]
+	decision := args[2]
+	if decision != CLAIM_HONOURED && decision != CLAIM_REJECTED {
+		return nil, errors.New("Decision should be HONOURED or REJECTED")
+	}
+	if decision == CLAIM_REJECTED && args[3] == "" {
+		return nil, errors.New("A rejection must give the reason")
+	}
+	record, err := mustGetReimbursement(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	claimNo, err := strconv.Atoi(args[1])
+	if err != nil || claimNo < 1 || claimNo > len(record.Claims) {
+		return nil, errors.New("No claim " + args[1] + " has been made under " + UID)
+	}
+	claim := &record.Claims[claimNo-1]
+	if claim.Status != CLAIM_PENDING {
+		return nil, errors.New("Claim " + args[1] + " has already been " + claim.Status)
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	claim.Status = decision
+	claim.Reason = args[3]
+	claim.DecidedOn = now.Format(time_format)
+	if decision == CLAIM_REJECTED {
+		return nil, putReimbursement(stub, record)
+	}
+
+	status, _, err := t.lc.GetStatus(stub, []string{UID})
+	if err != nil {
+		return nil, err
+	}
+	if string(status) == "ACCEPTED_BY_EB" {
+		// payment falls due on a complying presentation, not on the claim
+		edStatus, err := t.bl.GetStatus(stub, []string{UID})
+		if err != nil {
+			return nil, err
+		}
+		if string(edStatus) != "ACCEPTED_BY_IB" {
+			return nil, errors.New("A claim cannot be honoured before the issuing bank has accepted the export documents")
+		}
+	} else if string(status) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+		return nil, errors.New("A claim cannot be honoured under an LC that is " + string(status))
+	}
+	balance, err := t.claimableBalance(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	if claim.Principal > balance+0.005 {
+		return nil, fmt.Errorf("Claim of %.2f exceeds the outstanding balance of %.2f", claim.Principal, balance)
+	}
+
+	record.Honoured += claim.Principal
+	err = putReimbursement(stub, record)
+	if err != nil {
+		return nil, err
+	}
+	if string(status) == "ACCEPTED_BY_EB" {
+		err = t.makeLCPaymentDue(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+	}
+	payment, _ := json.Marshal(map[string]string{
+		"Amount":    strconv.FormatFloat(claim.Principal, 'f', 2, 64),
+		"Currency":  record.Currency,
+		"ValueDate": claim.ValueDate,
+		"PayerBank": record.ReimbursingBank,
+		"PayeeBank": claim.Tag58A,
+		"Reference": claim.Tag20,
+	})
+	return t.receiveLCPayment(stub, []string{UID, string(payment)})
+}
+
+// getReimbursement returns the reimbursement arrangement of an LC and its claims; args: UID
+func (t *TF) getReimbursement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1.")
+	}
+	record, err := mustGetReimbursement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(record)
+}
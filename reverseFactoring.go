@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// Approved payable states
+const (
+	PAYABLE_APPROVED       = "APPROVED"
+	PAYABLE_OFFERED        = "EARLY_PAYMENT_OFFERED"
+	PAYABLE_FUNDED         = "FUNDED"
+	PAYABLE_PAID           = "PAID"
+	PAYABLE_PAID_TO_FUNDER = "PAID_TO_FUNDER"
+)
+
+// ApprovedPayable is an invoice on an open-account PO that the importer has irrevocably undertaken
+// to pay at maturity, which a funder may pay early to the exporter at a discount (reverse factoring)
+type ApprovedPayable struct {
+	Currency     string
+	Amount       float64
+	MaturityDate string
+	ApprovedOn   string
+	Status       string
+	Offer        *EarlyPaymentOffer `json:"Offer,omitempty"`
+}
+
+// EarlyPaymentOffer is a funder's offer to pay an approved payable before maturity
+type EarlyPaymentOffer struct {
+	Funder       string
+	AnnualRate   float64
+	Days         int
+	Discount     float64
+	EarlyPayment float64
+	OfferedOn    string
+	FundedOn     string `json:"FundedOn,omitempty"`
+}
+
+// approvePayable makes the accepted invoice of an open-account PO a payable due at maturity
+func approvePayable(stub shim.ChaincodeStubInterface, po *PurchaseOrder, maturityDate string) error {
+	if po.IsLCRequired == "true" {
+		return errors.New("PO " + po.ContractId + " is paid under an LC; only open-account invoices can be approved as payables")
+	}
+	maturity, err := time.Parse(time_format, maturityDate)
+	if err != nil {
+		return errors.New("Incorrect date format for maturity date. Expecting mm/dd/yyyy")
+	}
+	amount, err := amountOfPO(po)
+	if err != nil {
+		return err
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return err
+	}
+	if maturity.Before(now.Truncate(24 * time.Hour)) {
+		return errors.New("Maturity date should not be in the past")
+	}
+	po.Payable = &ApprovedPayable{Currency: po.Currency, Amount: amount, MaturityDate: maturityDate, ApprovedOn: now.Format(time_format), Status: PAYABLE_APPROVED}
+	return nil
+}
+
+// offerEarlyPayment records a funder's offer to pay an approved payable early at a discount.
+// A better offer may replace one the exporter has not yet taken. args: PO number, funder, annual rate in percent, role
+func (t *PurchaseOrder) offerEarlyPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("offerEarlyPayment called ")
+	if len(args) != 4 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 4.")
+	}
+
+	poNumber := args[0] //PO num
+	who := args[3]      //Role
+	if who != "Funder" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+	if args[1] == "" {
+		return nil, errors.New("Funder: required field not provided")
+	}
+	rate, err := strconv.ParseFloat(args[2], 64)
+	if err != nil || rate < 0 {
+		return nil, errors.New("Annual rate should be a percentage of zero or more")
+	}
+
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+	payable := po.Payable
+	if payable == nil || (payable.Status != PAYABLE_APPROVED && payable.Status != PAYABLE_OFFERED) {
+		return nil, errors.New("PO " + poNumber + " has no approved payable open to early payment")
+	}
+
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	today, _ := time.Parse(time_format, now.Format(time_format))
+	maturity, _ := time.Parse(time_format, payable.MaturityDate)
+	offer := EarlyPaymentOffer{Funder: args[1], AnnualRate: rate, Days: int(maturity.Sub(today).Hours() / 24), OfferedOn: today.Format(time_format)}
+	if offer.Days <= 0 {
+		return nil, errors.New("The payable of PO " + poNumber + " has matured")
+	}
+	offer.Discount = math.Floor(payable.Amount*rate/100*float64(offer.Days)/360*100+0.5) / 100
+	offer.EarlyPayment = payable.Amount - offer.Discount
+	if payable.Offer != nil && offer.EarlyPayment <= payable.Offer.EarlyPayment {
+		return nil, errors.New("An offer of at least this early payment is already open")
+	}
+
+	payable.Offer = &offer
+	payable.Status = PAYABLE_OFFERED
+	return nil, putPO(stub, po)
+}
+
+// decideEarlyPayment has the exporter take up or decline the open early payment offer; args: PO number, ACCEPTED|DECLINED, role
+func (t *PurchaseOrder) decideEarlyPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	logger.Info("decideEarlyPayment called ")
+	if len(args) != 3 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 3.")
+	}
+
+	poNumber := args[0] //PO num
+	who := args[2]      //Role
+	if who != "Exporter" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+	if args[1] != "ACCEPTED" && args[1] != "DECLINED" {
+		return nil, errors.New("Decision should be ACCEPTED or DECLINED")
+	}
+
+	po, err := getPO(stub, poNumber)
+	if err != nil {
+		return nil, err
+	}
+	if po == nil {
+		return noPORecord(poNumber), nil
+	}
+	payable := po.Payable
+	if payable == nil || payable.Status != PAYABLE_OFFERED {
+		return nil, errors.New("No early payment has been offered for PO " + poNumber)
+	}
+
+	if args[1] == "DECLINED" {
+		payable.Offer = nil
+		payable.Status = PAYABLE_APPROVED
+		return nil, putPO(stub, po)
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	payable.Offer.FundedOn = now.Format(time_format)
+	payable.Status = PAYABLE_FUNDED
+	return nil, putPO(stub, po)
+}
+
+// settlePayable records who the importer's payment of an approved payable went to:
+// the funder once the payable has been funded, otherwise the exporter
+func settlePayable(po *PurchaseOrder) {
+	if po.Payable == nil {
+		return
+	}
+	if po.Payable.Status == PAYABLE_FUNDED {
+		po.Payable.Status = PAYABLE_PAID_TO_FUNDER
+	} else {
+		po.Payable.Status = PAYABLE_PAID
+		po.Payable.Offer = nil
+	}
+}
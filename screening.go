@@ -0,0 +1,600 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SANCTIONS_LIST prefixes the loaded versions of the sanctions/restricted-party list: SANCTIONS_LIST + version.
+// SANCTIONS_LIST + "CURRENT" holds the version in force.
+const SANCTIONS_LIST = "SANCTIONS~"
+
+// SCREENING prefixes the screening case of an LC contract or PO: SCREENING + LC|PO + "~" + ID
+const SCREENING = "SCREEN~"
+
+// COMPLIANCE_OFFICERS holds the certificates of the compliance officers, given as deploy arguments
+const COMPLIANCE_OFFICERS = "COMPLIANCE_OFFICERS"
+
+// Screening case states
+const (
+	SCREENING_CLEAR   = "CLEAR"
+	SCREENING_HOLD    = "SCREENING_HOLD"
+	SCREENING_CLEARED = "CLEARED"
+	SCREENING_BLOCKED = "BLOCKED"
+)
+
+// Kinds of listed entries and of the values screened against them
+const (
+	LISTED_PARTY  = "PARTY"
+	LISTED_VESSEL = "VESSEL"
+	LISTED_PORT   = "PORT"
+)
+
+// a hit needs at least this similarity between the normalised names
+const screeningThreshold = 0.85
+
+// legalForms are dropped from names before they are compared
+var legalForms = toSet(strings.Fields("THE LTD LIMITED INC INCORPORATED CO COMPANY CORP CORPORATION LLC PLC SA AG GMBH BV NV JSC OJSC PJSC SPA SRL"))
+
+// screeningGatedLC and screeningGatedPO are the functions a held or blocked LC contract or PO cannot go through
+var screeningGatedLC = toSet([]string{"acceptLC", "rejectLC", "submitED", "acceptED", "rejectED", "acceptToPay", "paymentReceived",
+	"transferLC", "presentTransferredDocs", "assignProceeds", "confirmLC", "payUnderConfirmation", "offerFinancing", "decideFinancing",
+	"authoriseReimbursement", "claimReimbursement", "decideReimbursementClaim"})
+var screeningGatedPO = toSet([]string{"updatePOStatus", "updatePODetails", "uploadLC", "uploadBOL", "uploadBOE", "uploadInvoice",
+	"acceptInvoice", "acceptPayment", "proposePOAmendment", "approvePOAmendment", "offerEarlyPayment", "decideEarlyPayment"})
+
+// SanctionedEntry is one party, vessel or port on the list
+type SanctionedEntry struct {
+	Name    string
+	Type    string   // PARTY, VESSEL or PORT
+	Aliases []string `json:",omitempty"`
+	Program string   `json:",omitempty"`
+}
+
+// SanctionsList is one loaded version of the list
+type SanctionsList struct {
+	Version  int
+	Source   string
+	LoadedOn string
+	Entries  []SanctionedEntry
+}
+
+// ScreenedValue is a name, vessel or port taken from a document
+type ScreenedValue struct {
+	Field string
+	Value string
+	Kind  string
+}
+
+// ScreeningHit is a screened value that resembles a listed entry
+type ScreeningHit struct {
+	Field      string
+	Value      string
+	ListedName string
+	ListedType string
+	Program    string `json:",omitempty"`
+	Score      float64
+	Cleared    bool
+}
+
+// ScreeningCase is the screening record of an LC contract or PO
+type ScreeningCase struct {
+	SubjectType string
+	SubjectID   string
+	Status      string
+	ListVersion int
+	ScreenedOn  string
+	Hits        []ScreeningHit
+	DecidedBy   string `json:",omitempty"`
+	DecidedOn   string `json:",omitempty"`
+	Comment     string `json:",omitempty"`
+}
+
+func screeningKey(subjectType string, ID string) string {
+	return SCREENING + subjectType + "~" + ID
+}
+
+func sanctionsListKey(version int) string {
+	return fmt.Sprintf("%s%06d", SANCTIONS_LIST, version)
+}
+
+func currentSanctionsVersion(stub shim.ChaincodeStubInterface) (int, error) {
+	recBytes, err := stub.GetState(SANCTIONS_LIST + "CURRENT")
+	if err != nil {
+		return 0, errors.New("Failed to get state for " + SANCTIONS_LIST + "CURRENT")
+	}
+	if recBytes == nil {
+		return 0, nil
+	}
+	return strconv.Atoi(string(recBytes))
+}
+
+func getSanctionsList(stub shim.ChaincodeStubInterface, version int) (*SanctionsList, error) {
+	recBytes, err := stub.GetState(sanctionsListKey(version))
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + sanctionsListKey(version))
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var list SanctionsList
+	err = json.Unmarshal(recBytes, &list)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal sanctions list version " + strconv.Itoa(version))
+	}
+	return &list, nil
+}
+
+func getScreeningCase(stub shim.ChaincodeStubInterface, subjectType string, ID string) (*ScreeningCase, error) {
+	recBytes, err := stub.GetState(screeningKey(subjectType, ID))
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + screeningKey(subjectType, ID))
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var screening ScreeningCase
+	err = json.Unmarshal(recBytes, &screening)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal screening of " + ID)
+	}
+	return &screening, nil
+}
+
+func putComplianceOfficers(stub shim.ChaincodeStubInterface, certificates []string) error {
+	recBytes, _ := json.Marshal(certificates)
+	return stub.PutState(COMPLIANCE_OFFICERS, recBytes)
+}
+
+// isCallerComplianceOfficer checks that the caller holds the certificate of one of the compliance officers
+func (t *TF) isCallerComplianceOfficer(stub shim.ChaincodeStubInterface) (bool, error) {
+	recBytes, err := stub.GetState(COMPLIANCE_OFFICERS)
+	if err != nil {
+		return false, errors.New("Failed to get state for " + COMPLIANCE_OFFICERS)
+	}
+	certificates := make([]string, 0)
+	if recBytes != nil {
+		err = json.Unmarshal(recBytes, &certificates)
+		if err != nil {
+			return false, errors.New("Failed to unmarshal " + COMPLIANCE_OFFICERS)
+		}
+	}
+	for _, certificate := range certificates {
+		ok, err := t.isCaller(stub, []byte(certificate))
+		if err == nil && ok {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func putScreeningCase(stub shim.ChaincodeStubInterface, screening *ScreeningCase) error {
+	recBytes, _ := json.Marshal(screening)
+	return stub.PutState(screeningKey(screening.SubjectType, screening.SubjectID), recBytes)
+}
+
+// loadSanctionsList loads a new version of the sanctions list; args: list JSON {"Source":"","Entries":[...]}, role
+func (t *TF) loadSanctionsList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+	if args[1] != "ComplianceOfficer" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+
+	var list SanctionsList
+	err := json.Unmarshal([]byte(args[0]), &list)
+	if err != nil {
+		return nil, errors.New("Sanctions list should be a JSON object " + err.Error())
+	}
+	for i, entry := range list.Entries {
+		if normaliseName(entry.Name) == "" {
+			return nil, fmt.Errorf("Entries[%d].Name: required field not provided", i)
+		}
+		if entry.Type != LISTED_PARTY && entry.Type != LISTED_VESSEL && entry.Type != LISTED_PORT {
+			return nil, fmt.Errorf("Entries[%d].Type should be PARTY, VESSEL or PORT", i)
+		}
+	}
+
+	version, err := currentSanctionsVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	list.Version = version + 1
+	list.LoadedOn = now.Format(time_format)
+
+	recBytes, _ := json.Marshal(list)
+	err = stub.PutState(sanctionsListKey(list.Version), recBytes)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(strconv.Itoa(list.Version)), stub.PutState(SANCTIONS_LIST+"CURRENT", []byte(strconv.Itoa(list.Version)))
+}
+
+// normaliseName upper-cases a name, drops punctuation and legal forms and collapses spaces
+func normaliseName(name string) string {
+	cleaned := strings.Map(func(r rune) rune {
+		if (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return ' '
+	}, strings.ToUpper(name))
+	words := make([]string, 0)
+	for _, word := range strings.Fields(cleaned) {
+		if !legalForms[word] {
+			words = append(words, word)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// editDistance is the Levenshtein distance between two strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = minInt(minInt(previous[j]+1, current[j-1]+1), previous[j-1]+cost)
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// similarity is 1 for identical strings, falling towards 0 with the edit distance
+func similarity(a string, b string) float64 {
+	longest := len(a)
+	if len(b) > longest {
+		longest = len(b)
+	}
+	if longest == 0 {
+		return 0
+	}
+	return 1 - float64(editDistance(a, b))/float64(longest)
+}
+
+// nameScore compares a normalised screened value with a normalised listed name. Besides the similarity of the
+// whole strings, a value containing every word of the listed name scores as a hit, so "JSC ACME ARMS MOSCOW"
+// hits "ACME ARMS"; words of five letters or more may differ by one letter.
+func nameScore(value string, listed string) float64 {
+	score := similarity(value, listed)
+	listedWords := strings.Fields(listed)
+	if len(listedWords) == 1 && len(listed) < 5 {
+		return score
+	}
+	valueWords := strings.Fields(value)
+	for _, listedWord := range listedWords {
+		found := false
+		for _, valueWord := range valueWords {
+			if valueWord == listedWord || (len(listedWord) >= 5 && editDistance(valueWord, listedWord) <= 1) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return score
+		}
+	}
+	if score < 0.9 {
+		score = 0.9
+	}
+	return score
+}
+
+// screenValues matches values against the entries of their kind. Each line of a multi-line value,
+// such as a name and address, is screened on its own.
+func screenValues(list *SanctionsList, values []ScreenedValue) []ScreeningHit {
+	hits := make([]ScreeningHit, 0)
+	for _, value := range values {
+		// a value stored encrypted and read without its key cannot be matched, so it is held for a compliance officer
+		if isEncrypted(value.Value) {
+			hits = append(hits, ScreeningHit{Field: value.Field, Value: value.Value, ListedName: "(encrypted)", ListedType: value.Kind, Score: 1})
+			continue
+		}
+		for _, line := range strings.Split(value.Value, "\n") {
+			normalised := normaliseName(line)
+			if normalised == "" {
+				continue
+			}
+			for _, entry := range list.Entries {
+				if entry.Type != value.Kind {
+					continue
+				}
+				best := 0.0
+				for _, name := range append([]string{entry.Name}, entry.Aliases...) {
+					if score := nameScore(normalised, normaliseName(name)); score > best {
+						best = score
+					}
+				}
+				if best >= screeningThreshold {
+					hits = append(hits, ScreeningHit{Field: value.Field, Value: strings.TrimSpace(line), ListedName: entry.Name, ListedType: entry.Type, Program: entry.Program, Score: float64(int(best*100)) / 100})
+				}
+			}
+		}
+	}
+	return hits
+}
+
+// screenSubject screens the values of an LC contract or PO against the list in force
+func screenSubject(stub shim.ChaincodeStubInterface, subjectType string, ID string, values []ScreenedValue) (*ScreeningCase, error) {
+	version, err := currentSanctionsVersion(stub)
+	if err != nil || version == 0 {
+		return nil, err
+	}
+	list, err := getSanctionsList(stub, version)
+	if err != nil {
+		return nil, err
+	}
+	return raiseScreeningHits(stub, subjectType, ID, version, screenValues(list, values))
+}
+
+// raiseScreeningHits adds hits to the screening case of an LC contract or PO. New hits put the subject on
+// SCREENING_HOLD; hits a compliance officer has already cleared are not raised again. listVersion is the
+// sanctions list the hits were found with, 0 for hits that do not come from it.
+func raiseScreeningHits(stub shim.ChaincodeStubInterface, subjectType string, ID string, listVersion int, hits []ScreeningHit) (*ScreeningCase, error) {
+	screening, err := getScreeningCase(stub, subjectType, ID)
+	if err != nil {
+		return nil, err
+	}
+	if screening == nil {
+		screening = &ScreeningCase{SubjectType: subjectType, SubjectID: ID, Status: SCREENING_CLEAR, Hits: make([]ScreeningHit, 0)}
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	if listVersion > 0 {
+		screening.ListVersion = listVersion
+	}
+	screening.ScreenedOn = now.Format(time_format)
+
+	for _, hit := range hits {
+		known := false
+		for _, existing := range screening.Hits {
+			if existing.Field == hit.Field && existing.Value == hit.Value && existing.ListedName == hit.ListedName {
+				known = true
+				break
+			}
+		}
+		if !known {
+			screening.Hits = append(screening.Hits, hit)
+			if screening.Status != SCREENING_BLOCKED {
+				screening.Status = SCREENING_HOLD
+			}
+		}
+	}
+	return screening, putScreeningCase(stub, screening)
+}
+
+// requireScreeningClear fails while an LC contract or PO is on hold or has been blocked
+func requireScreeningClear(stub shim.ChaincodeStubInterface, subjectType string, ID string) error {
+	screening, err := getScreeningCase(stub, subjectType, ID)
+	if err != nil || screening == nil {
+		return err
+	}
+	if screening.Status == SCREENING_HOLD {
+		return errors.New(subjectType + " " + ID + " is on SCREENING_HOLD until a compliance officer clears its sanctions screening hits")
+	}
+	if screening.Status == SCREENING_BLOCKED {
+		return errors.New(subjectType + " " + ID + " has been blocked by sanctions screening")
+	}
+	return nil
+}
+
+// screeningStatus is the status of the screening case of a subject, empty if it was never screened
+func screeningStatus(stub shim.ChaincodeStubInterface, subjectType string, ID string) (string, error) {
+	screening, err := getScreeningCase(stub, subjectType, ID)
+	if err != nil || screening == nil {
+		return "", err
+	}
+	return screening.Status, nil
+}
+
+// lcScreenedValues are the parties, banks and ports named on an LC contract
+func lcScreenedValues(lc *LC, importer string, exporter string, importerBank string, exporterBank string) []ScreenedValue {
+	return []ScreenedValue{
+		{"Importer", importer, LISTED_PARTY},
+		{"Exporter", exporter, LISTED_PARTY},
+		{"ImporterBank", importerBank, LISTED_PARTY},
+		{"ExporterBank", exporterBank, LISTED_PARTY},
+		{"Tag50", lc.Tag50, LISTED_PARTY},
+		{"Tag59", lc.Tag59, LISTED_PARTY},
+		{"Tag57D", lc.Tag57D, LISTED_PARTY},
+		{"Tag53A", lc.Tag53A, LISTED_PARTY},
+		{"Tag44A", lc.Tag44A, LISTED_PORT},
+		{"Tag44B", lc.Tag44B, LISTED_PORT},
+		{"Tag44E", lc.Tag44E, LISTED_PORT},
+		{"Tag44F", lc.Tag44F, LISTED_PORT},
+	}
+}
+
+// screenLC screens the LC of a contract as submitted
+func (t *TF) screenLC(stub shim.ChaincodeStubInterface, UID string, lcJSON string) error {
+	var lc LC
+	err := json.Unmarshal([]byte(lcJSON), &lc)
+	if err != nil {
+		return err
+	}
+	row, err := getContractRow(stub, UID)
+	if err != nil {
+		return err
+	}
+	_, err = screenSubject(stub, "LC", UID, lcScreenedValues(&lc, row.Columns[3].GetString_(), row.Columns[4].GetString_(), row.Columns[5].GetString_(), row.Columns[6].GetString_()))
+	return err
+}
+
+// screenED screens the parties, vessel and ports of the export documents presented under an LC
+func (t *TF) screenED(stub shim.ChaincodeStubInterface, UID string, BLJSON string, invoiceJSON string, shippingCompany string, insuranceCompany string) error {
+	values := []ScreenedValue{
+		{"ShippingCompany", shippingCompany, LISTED_PARTY},
+		{"InsuranceCompany", insuranceCompany, LISTED_PARTY},
+	}
+	var bl BL
+	if json.Unmarshal([]byte(BLJSON), &bl) == nil {
+		values = append(values,
+			ScreenedValue{"SHIPPER_NAME_ADDRESS", bl.SHIPPER_NAME_ADDRESS, LISTED_PARTY},
+			ScreenedValue{"CONSIGNEE_NAME_ADDRESS", bl.CONSIGNEE_NAME_ADDRESS, LISTED_PARTY},
+			ScreenedValue{"VESSEL", bl.VESSEL, LISTED_VESSEL},
+			ScreenedValue{"PORT_OF_LOADING", bl.PORT_OF_LOADING, LISTED_PORT},
+			ScreenedValue{"PORT_OF_DISCHARGE", bl.PORT_OF_DISCHARGE, LISTED_PORT},
+			ScreenedValue{"PLACE_OF_RECEIPT", bl.PLACE_OF_RECEIPT, LISTED_PORT},
+			ScreenedValue{"PLACE_OF_DELIVERY", bl.PLACE_OF_DELIVERY, LISTED_PORT})
+	}
+	var invoice Invoice
+	if json.Unmarshal([]byte(invoiceJSON), &invoice) == nil {
+		values = append(values,
+			ScreenedValue{"PAYER", invoice.PAYER, LISTED_PARTY},
+			ScreenedValue{"PAYEE", invoice.PAYEE, LISTED_PARTY})
+	}
+	_, err := screenSubject(stub, "LC", UID, values)
+	return err
+}
+
+// screenPO screens the parties and ports of a PO and the HS codes of its line items
+func screenPO(stub shim.ChaincodeStubInterface, po *PurchaseOrder) error {
+	screening, err := screenSubject(stub, "PO", po.ContractId, []ScreenedValue{
+		{"Importer", po.Importer, LISTED_PARTY},
+		{"Exporter", po.Exporter, LISTED_PARTY},
+		{"ImporterBank", po.ImporterBank, LISTED_PARTY},
+		{"ExporterBank", po.ExporterBank, LISTED_PARTY},
+		{"ShippingCompany", po.ShippingCompany, LISTED_PARTY},
+		{"InsuranceCompany", po.InsuranceCompany, LISTED_PARTY},
+		{"PortofShipment", po.PortofShipment, LISTED_PORT},
+		{"PortofDischarge", po.PortofDischarge, LISTED_PORT},
+	})
+	if err != nil {
+		return err
+	}
+	// line items whose HS codes are on the controlled-goods list are held the same way
+	hits, err := controlledGoodsHits(stub, poHSLines(po))
+	if err != nil {
+		return err
+	}
+	if len(hits) > 0 {
+		screening, err = raiseScreeningHits(stub, "PO", po.ContractId, 0, hits)
+		if err != nil {
+			return err
+		}
+	}
+	if screening != nil {
+		po.ScreeningStatus = screening.Status
+	}
+	return nil
+}
+
+// decideScreening has a compliance officer clear the hits of a held LC contract or PO, or block it;
+// args: LC|PO, ID, CLEARED|BLOCKED, comment, officer, role
+func (t *TF) decideScreening(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 6 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 6.")
+	}
+	if args[5] != "ComplianceOfficer" {
+		return nil, errors.New("Not Authorized to access this service ")
+	}
+	subjectType, ID, decision := args[0], args[1], args[2]
+	if decision != SCREENING_CLEARED && decision != SCREENING_BLOCKED {
+		return nil, errors.New("Decision should be CLEARED or BLOCKED")
+	}
+	if args[3] == "" {
+		return nil, errors.New("Comment: required field not provided")
+	}
+
+	screening, err := getScreeningCase(stub, subjectType, ID)
+	if err != nil {
+		return nil, err
+	}
+	if screening == nil || screening.Status != SCREENING_HOLD {
+		return nil, errors.New(subjectType + " " + ID + " is not on SCREENING_HOLD")
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	screening.Status = decision
+	screening.Comment = args[3]
+	screening.DecidedBy = args[4]
+	screening.DecidedOn = now.Format(time_format)
+	if decision == SCREENING_CLEARED {
+		for i := range screening.Hits {
+			screening.Hits[i].Cleared = true
+		}
+	}
+	err = putScreeningCase(stub, screening)
+	if err != nil {
+		return nil, err
+	}
+
+	if subjectType == "PO" {
+		po, err := getPO(stub, ID)
+		if err != nil || po == nil {
+			return nil, err
+		}
+		po.ScreeningStatus = decision
+		return nil, putPO(stub, po)
+	}
+	return nil, t.updateContractSummary(stub, ID)
+}
+
+// getScreening returns the screening case of an LC contract or PO; args: LC|PO, ID
+func (t *TF) getScreening(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+	}
+	screening, err := getScreeningCase(stub, args[0], args[1])
+	if err != nil {
+		return nil, err
+	}
+	if screening == nil {
+		return nil, errors.New(args[0] + " " + args[1] + " has not been screened")
+	}
+	return json.Marshal(screening)
+}
+
+// getSanctionsList returns a version of the sanctions list, the one in force if none is given; args: optional version
+func (t *TF) getSanctionsList(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) > 1 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 0 or 1.")
+	}
+	version, err := currentSanctionsVersion(stub)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 1 {
+		version, err = strconv.Atoi(args[0])
+		if err != nil {
+			return nil, errors.New("Version should be a number")
+		}
+	}
+	list, err := getSanctionsList(stub, version)
+	if err != nil {
+		return nil, err
+	}
+	if list == nil {
+		return nil, errors.New("No sanctions list version " + strconv.Itoa(version) + " has been loaded")
+	}
+	return json.Marshal(list)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+)
+
+// SETTLEMENT prefixes the settlement ledger of a contract: SETTLEMENT + contract type + "~" + UID.
+// The type keeps a PO number from meeting an LC contract ID.
+const SETTLEMENT = "SETTLE~"
+
+// Settlement states
+const (
+	SETTLEMENT_OPEN    = "OPEN"
+	SETTLEMENT_PARTIAL = "PARTIALLY_PAID"
+	SETTLEMENT_SETTLED = "SETTLED"
+)
+
+// Payment is one payment made against a contract
+type Payment struct {
+	PaymentNo int
+	Amount    float64
+	Currency  string
+	ValueDate string
+	PayerBank string
+	PayeeBank string
+	Reference string
+	TxID      string
+}
+
+// Settlement is the ledger of payments against the amount due on a contract
+type Settlement struct {
+	ContractID   string
+	ContractType string // LC or PO
+	Currency     string
+	AmountDue    float64
+	Paid         float64
+	Outstanding  float64
+	DueDate      string
+	Status       string
+	Payments     []Payment
+}
+
+func settlementKey(contractType string, UID string) string {
+	return SETTLEMENT + contractType + "~" + UID
+}
+
+// getSettlement reads the settlement ledger of an LC or PO; contractType is "LC" or "PO"
+func getSettlement(stub shim.ChaincodeStubInterface, contractType string, UID string) (*Settlement, error) {
+	recBytes, err := stub.GetState(settlementKey(contractType, UID))
+	if err != nil {
+		return nil, errors.New("Failed to get state for " + settlementKey(contractType, UID))
+	}
+	if recBytes == nil {
+		return nil, nil
+	}
+	var settlement Settlement
+	err = json.Unmarshal(recBytes, &settlement)
+	if err != nil {
+		return nil, errors.New("Failed to unmarshal settlement of " + UID)
+	}
+	return &settlement, nil
+}
+
+func putSettlement(stub shim.ChaincodeStubInterface, settlement *Settlement) error {
+	recBytes, _ := json.Marshal(settlement)
+	return stub.PutState(settlementKey(settlement.ContractType, settlement.ContractID), recBytes)
+}
+
+// openSettlement starts the settlement ledger of a contract when payment becomes due.
+// An existing ledger is returned unchanged.
+func openSettlement(stub shim.ChaincodeStubInterface, UID string, contractType string, currency string, amountDue float64, dueDate string) (*Settlement, error) {
+	settlement, err := getSettlement(stub, contractType, UID)
+	if err != nil || settlement != nil {
+		return settlement, err
+	}
+	settlement = &Settlement{
+		ContractID:   UID,
+		ContractType: contractType,
+		Currency:     currency,
+		AmountDue:    amountDue,
+		Outstanding:  amountDue,
+		DueDate:      dueDate,
+		Status:       SETTLEMENT_OPEN,
+		Payments:     make([]Payment, 0),
+	}
+	return settlement, putSettlement(stub, settlement)
+}
+
+// parsePayment reads and checks a payment given as JSON:
+// {"Amount":"1000.00","Currency":"USD","ValueDate":"mm/dd/yyyy","PayerBank":"","PayeeBank":"","Reference":""}
+func parsePayment(paymentJSON string) (*Payment, error) {
+	var input struct {
+		Amount    string
+		Currency  string
+		ValueDate string
+		PayerBank string
+		PayeeBank string
+		Reference string
+	}
+	err := json.Unmarshal([]byte(paymentJSON), &input)
+	if err != nil {
+		return nil, errors.New("Payment should be a JSON object " + err.Error())
+	}
+
+	payment := Payment{Currency: input.Currency, ValueDate: input.ValueDate, PayerBank: input.PayerBank, PayeeBank: input.PayeeBank, Reference: input.Reference}
+	payment.Amount, err = parseDecimal(input.Amount)
+	if err != nil || payment.Amount <= 0 {
+		return nil, errors.New("Payment amount should be a positive number")
+	}
+	if !isoCurrencyCodes[payment.Currency] {
+		return nil, errors.New("Payment currency " + payment.Currency + " is not an ISO 4217 currency code")
+	}
+	if _, err = time.Parse(time_format, payment.ValueDate); err != nil {
+		return nil, errors.New("Incorrect date format for ValueDate. Expecting mm/dd/yyyy")
+	}
+	if payment.Reference == "" {
+		return nil, errors.New("Payment reference: required field not provided")
+	}
+	return &payment, nil
+}
+
+// addPayment books a payment against the outstanding balance
+func (s *Settlement) addPayment(stub shim.ChaincodeStubInterface, payment Payment) error {
+	if s.Status == SETTLEMENT_SETTLED {
+		return errors.New("Contract " + s.ContractID + " is already settled")
+	}
+	if payment.Currency != s.Currency {
+		return errors.New("Payment currency " + payment.Currency + " does not match the amount due in " + s.Currency)
+	}
+	for _, existing := range s.Payments {
+		if existing.Reference == payment.Reference {
+			return errors.New("Payment " + payment.Reference + " has already been recorded")
+		}
+	}
+	if payment.Amount > s.Outstanding+0.005 {
+		return fmt.Errorf("Payment of %.2f exceeds the outstanding balance of %.2f", payment.Amount, s.Outstanding)
+	}
+
+	payment.PaymentNo = len(s.Payments) + 1
+	payment.TxID = stub.GetTxID()
+	s.Payments = append(s.Payments, payment)
+	s.Paid += payment.Amount
+	s.Outstanding = s.AmountDue - s.Paid
+	if s.Outstanding < 0.005 {
+		s.Outstanding = 0
+		s.Status = SETTLEMENT_SETTLED
+	} else {
+		s.Status = SETTLEMENT_PARTIAL
+	}
+	return nil
+}
+
+// paymentOrBalance returns the payment given as JSON, or a payment of the whole outstanding balance
+// on the transaction date for callers that do not give payment details
+func paymentOrBalance(stub shim.ChaincodeStubInterface, settlement *Settlement, args []string, index int) (*Payment, error) {
+	if len(args) > index && args[index] != "" {
+		return parsePayment(args[index])
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	return &Payment{Amount: settlement.Outstanding, Currency: settlement.Currency, ValueDate: now.Format(time_format), Reference: stub.GetTxID()}, nil
+}
+
+// openLCSettlement opens the settlement ledger of an LC for the amount of the accepted invoice
+func (t *TF) openLCSettlement(stub shim.ChaincodeStubInterface, UID string) (*Settlement, error) {
+	settlement, err := getSettlement(stub, "LC", UID)
+	if err != nil || settlement != nil {
+		return settlement, err
+	}
+	currency, amount, err := t.contractAmount(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	dueDate, err := t.lcDueDate(stub, UID)
+	if err != nil {
+		return nil, err
+	}
+	return openSettlement(stub, UID, "LC", currency, amount, dueDate.Format(time_format))
+}
+
+// recordLCPayment books a payment against an LC that is due for payment. args: UID, optional payment JSON
+func (t *TF) recordLCPayment(stub shim.ChaincodeStubInterface, args []string) (*Settlement, error) {
+	settlement, err := t.openLCSettlement(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	payment, err := paymentOrBalance(stub, settlement, args, 1)
+	if err != nil {
+		return nil, err
+	}
+	err = settlement.addPayment(stub, *payment)
+	if err != nil {
+		return nil, err
+	}
+	return settlement, putSettlement(stub, settlement)
+}
+
+// recordPOPayment books a payment against an open-account PO. args: PO number, payment status, role, optional payment JSON
+func (t *PurchaseOrder) recordPOPayment(stub shim.ChaincodeStubInterface, po *PurchaseOrder, args []string) (*Settlement, error) {
+	currency := po.Currency
+	amount, err := amountOfPO(po)
+	if err != nil {
+		return nil, err
+	}
+	//an approved payable is what the importer undertook to pay
+	if po.Payable != nil {
+		currency = po.Payable.Currency
+		amount = po.Payable.Amount
+	}
+	now, err := txDate(stub)
+	if err != nil {
+		return nil, err
+	}
+	settlement, err := openSettlement(stub, po.ContractId, "PO", currency, amount, now.Format(time_format))
+	if err != nil {
+		return nil, err
+	}
+	payment, err := paymentOrBalance(stub, settlement, args, 3)
+	if err != nil {
+		return nil, err
+	}
+	err = settlement.addPayment(stub, *payment)
+	if err != nil {
+		return nil, err
+	}
+	return settlement, putSettlement(stub, settlement)
+}
+
+// makeLCPaymentDue moves an LC to PAYMENT_DUE_FROM_IB_TO_EB and opens its settlement ledger
+func (t *TF) makeLCPaymentDue(stub shim.ChaincodeStubInterface, UID string) error {
+	_, err := t.lc.UpdateStatus(stub, []string{UID, "Payment_due", "PAYMENT_DUE_FROM_IB_TO_EB"})
+	if err != nil {
+		return err
+	}
+	_, err = t.openLCSettlement(stub, UID)
+	if err != nil {
+		return err
+	}
+	return t.contractChanged(stub, UID, "PAYMENT_DUE_FROM_IB_TO_EB", "", "", "")
+}
+
+// receiveLCPayment books a payment against an LC that is due and, once the balance is settled,
+// moves the LC to PAYMENT_RECEIVED and pays out the proceeds; args: UID, optional payment JSON
+func (t *TF) receiveLCPayment(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	lcStatus, _, err := t.lc.GetStatus(stub, []string{args[0]})
+	if err != nil {
+		return nil, err
+	}
+	if string(lcStatus) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+		return nil, errors.New("Payment is not yet due.")
+	}
+
+	settlement, err := t.recordLCPayment(stub, args)
+	if err != nil {
+		return nil, err
+	}
+	if settlement.Status != SETTLEMENT_SETTLED {
+		return nil, nil
+	}
+
+	_, err = t.lc.UpdateStatus(stub, []string{args[0], "Payment", "PAYMENT_RECEIVED"})
+	if err != nil {
+		return nil, err
+	}
+	err = dischargeConfirmation(stub, args[0])
+	if err != nil {
+		return nil, err
+	}
+	err = releaseExposure(stub, args[0], "PAID")
+	if err != nil {
+		return nil, err
+	}
+	_, err = t.distributeProceeds(stub, args[0], settlement.Currency, settlement.Paid)
+	if err != nil {
+		return nil, err
+	}
+	return nil, t.contractChanged(stub, args[0], "PAYMENT_RECEIVED", "", PO_PAID, "ExporterBank")
+}
+
+// getSettlement returns the settlement ledger of a contract; args: UID, optionally the contract type LC (default) or PO
+func (t *TF) getSettlement(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	if len(args) != 1 && len(args) != 2 {
+		return nil, errors.New("Incorrect number of arguments. Expecting 1 or 2.")
+	}
+	contractType := "LC"
+	if len(args) == 2 {
+		contractType = args[1]
+	}
+	if contractType != "LC" && contractType != "PO" {
+		return nil, errors.New("Contract type should be LC or PO")
+	}
+	settlement, err := getSettlement(stub, contractType, args[0])
+	if err != nil {
+		return nil, err
+	}
+	if settlement == nil {
+		return nil, errors.New("No payment is due on " + args[0])
+	}
+	return json.Marshal(settlement)
+}
+
+// getOutstandingBalances lists the contracts with a balance still to be paid
+func (t *TF) getOutstandingBalances(stub shim.ChaincodeStubInterface, args []string) ([]byte, error) {
+	// '\x7f' sorts directly after the '~' that ends the prefix
+	iter, err := stub.RangeQueryState(SETTLEMENT, SETTLEMENT[:len(SETTLEMENT)-1]+"\x7f")
+	if err != nil {
+		return nil, errors.New("Failed to query settlements")
+	}
+	defer iter.Close()
+
+	type balance struct {
+		ContractID   string
+		ContractType string
+		Currency     string
+		AmountDue    float64
+		Outstanding  float64
+		DueDate      string
+	}
+	balances := make([]balance, 0)
+	for iter.HasNext() {
+		_, value, err := iter.Next()
+		if err != nil {
+			return nil, errors.New("Failed to read settlements")
+		}
+		var settlement Settlement
+		err = json.Unmarshal(value, &settlement)
+		if err != nil {
+			return nil, err
+		}
+		if settlement.Status == SETTLEMENT_SETTLED {
+			continue
+		}
+		balances = append(balances, balance{settlement.ContractID, settlement.ContractType, settlement.Currency, settlement.AmountDue, settlement.Outstanding, settlement.DueDate})
+	}
+	return json.Marshal(balances)
+}
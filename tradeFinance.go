@@ -81,6 +81,8 @@ type TF struct {
 	invoice Invoice
 	pl      PL
 	po      PurchaseOrder
+	dc      DC
+	gt      GT
 }
 
 // Init initializes the smart contracts
@@ -121,6 +123,14 @@ func (t *TF) Init(stub shim.ChaincodeStubInterface, function string, args []stri
 	t.pl.Init(stub, function, args)
 	t.po.Init(stub, function, args)
 
+	// the deploy arguments are the certificates of the compliance officers
+	if len(args) > 0 {
+		err = putComplianceOfficers(stub, args)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	return nil, nil
 }
 
@@ -1305,11 +1315,34 @@ func (t *TF) crossCheckDocs(args []string) (bool, error) {
 	return true, nil
 }
 
+// contractChanged is called after every write to a contract. It reflects the change on the linked purchase order
+// and refreshes the contract summary read by searchContracts.
+func (t *TF) contractChanged(stub shim.ChaincodeStubInterface, UID string, lcStatus string, edStatus string, poStatus string, who string) error {
+	err := t.po.recordLCEvent(stub, UID, lcStatus, edStatus, poStatus, who)
+	if err != nil {
+		return err
+	}
+	return t.updateContractSummary(stub, UID)
+}
+
 // Invoke invokes the chaincode
 //Fabric version migration to 0.6
 //func (t *TF) Invoke(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
 func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 
+	// Contracts and POs held or blocked by sanctions screening cannot move on
+	if screeningGatedLC[function] && len(args) > 0 {
+		err := requireScreeningClear(stub, "LC", args[0])
+		if err != nil {
+			return nil, err
+		}
+	} else if screeningGatedPO[function] && len(args) > 0 {
+		err := requireScreeningClear(stub, "PO", args[0])
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	if function == "submitLC" {
 		/*
 			if len(args) != 10 {
@@ -1340,6 +1373,43 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 		shippingCompany := ""
 		insuranceCompany := ""
 
+		// LC contracts share the document tables with collections, so the IDs must not clash
+		collection, err := getDCRecord(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+		if collection != nil {
+			return nil, errors.New("Contract " + UID + " already exists.")
+		}
+
+		// An optional 11th argument links the LC to the purchase order it is raised for
+		poNumber := ""
+		if len(args) > 10 {
+			poNumber = args[10]
+		}
+		// An optional 12th argument is the LC PDF, kept off the ledger
+		lcDoc := ""
+		if len(args) > 11 {
+			lcDoc = args[11]
+		}
+		if poNumber != "" {
+			prefilledJSON, err := t.po.prefillLC(stub, poNumber, lcJSON)
+			if err != nil {
+				return nil, err
+			}
+			lcJSON = prefilledJSON
+		}
+
+		// The issuing bank's credit limits are checked before anything is written
+		exposure, err := newExposure(UID, lcJSON, importerName, importerBankName, exporterBankName)
+		if err != nil {
+			return nil, err
+		}
+		err = reserveExposure(stub, exposure)
+		if err != nil {
+			return nil, err
+		}
+
 		// Insert a row
 		ok, err := stub.InsertRow("BPTable", shim.Row{
 			Columns: []*shim.Column{
@@ -1365,7 +1435,37 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			return nil, errors.New("Row already exists.")
 		}
 
-		return t.lc.SubmitDoc(stub, []string{UID, lcJSON, ""})
+		// The PDF is stored once the LC has passed its checks, so a rejected LC leaves no blob behind
+		res, err := t.lc.ValidateDoc(stub, []string{lcJSON})
+		if err != nil {
+			return nil, err
+		}
+		if string(res) == "FAILURE" {
+			return nil, errors.New("Document validation failed.")
+		}
+		lcPDF, err := storeDocument(stub, UID, "LC", lcDoc)
+		if err != nil {
+			return nil, err
+		}
+		res, err = t.lc.SubmitDoc(stub, []string{UID, lcJSON, lcPDF})
+		if err != nil {
+			return res, err
+		}
+		err = recordFingerprints(stub, UID, "LC", lcJSON, lcDoc, importerBankName, "ImporterBank")
+		if err != nil {
+			return nil, err
+		}
+		if poNumber != "" {
+			err = t.po.linkLC(stub, poNumber, UID, lcJSON)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = t.screenLC(stub, UID, lcJSON)
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.contractChanged(stub, UID, "", "", "", "")
 	} else if function == "acceptLC" {
 		if accessControlFlag == true {
 			res, err := t.isCallerExporterBank(stub, []string{args[0]})
@@ -1377,7 +1477,11 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			}
 		}
 		args = append(args, "ACCEPTED_BY_EB")
-		return t.lc.UpdateStatus(stub, args)
+		_, err := t.lc.UpdateStatus(stub, args)
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.contractChanged(stub, args[0], "ACCEPTED_BY_EB", "", "", "")
 	} else if function == "paymentReceived" {
 
 		if accessControlFlag == true {
@@ -1391,18 +1495,8 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			}
 		}
 
-		lcStatus, _, err := t.lc.GetStatus(stub, []string{args[0]})
-		if err != nil {
-			return nil, err
-		}
-
-		if string(lcStatus) == "PAYMENT_DUE_FROM_IB_TO_EB" {
-			args = append(args, "Payment")
-			args = append(args, "PAYMENT_RECEIVED")
-			return t.lc.UpdateStatus(stub, args)
-		}
-		return nil, errors.New("Payment is not yet due.")
-
+		// An optional second argument gives the payment details; without it the balance is taken as paid
+		return t.receiveLCPayment(stub, args)
 	} else if function == "defaultedOnPayment" {
 		if accessControlFlag == true {
 			//res, err := t.isCallerExporterBank(stub, []string{args[0], string(sigma), string(payload), string(binding)})
@@ -1415,10 +1509,29 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			}
 		}
 
-		args = append(args, "Payment_defaulted")
-		args = append(args, "PAYMENT_DEFAULTED")
+		// Only a payment that has fallen due can be defaulted on
+		lcStatus, _, err := t.lc.GetStatus(stub, []string{args[0]})
+		if err != nil {
+			return nil, err
+		}
+		if string(lcStatus) != "PAYMENT_DUE_FROM_IB_TO_EB" {
+			return nil, errors.New("Payment is not yet due.")
+		}
 
-		return t.lc.UpdateStatus(stub, args)
+		// An optional second argument gives the reason for the default
+		reason := ""
+		if len(args) > 1 {
+			reason = args[1]
+		}
+		err = t.recordDefault(stub, args[0], reason)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.lc.UpdateStatus(stub, []string{args[0], "Payment_defaulted", "PAYMENT_DEFAULTED"})
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.contractChanged(stub, args[0], "PAYMENT_DEFAULTED", "", "", "")
 	} else if function == "rejectLC" {
 		if accessControlFlag == true {
 			res, err := t.isCallerExporterBank(stub, []string{args[0]})
@@ -1430,17 +1543,86 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			}
 		}
 		args = append(args, "REJECTED_BY_EB")
-		return t.lc.UpdateStatus(stub, args)
+		_, err := t.lc.UpdateStatus(stub, args)
+		if err != nil {
+			return nil, err
+		}
+		// a rejected LC draws nothing until it is resubmitted, which reserves its exposure again
+		err = releaseExposure(stub, args[0], "REJECTED")
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.contractChanged(stub, args[0], "REJECTED_BY_EB", "", "", "")
 	} else if function == "reSubmitLC" {
-		if len(args) != 11 {
-			return nil, fmt.Errorf("Incorrect number of arguments. Expecting 11. Got: %d.", len(args))
+		if len(args) != 11 && len(args) != 12 {
+			return nil, fmt.Errorf("Incorrect number of arguments. Expecting 11 or 12. Got: %d.", len(args))
 		}
 
 		UID := args[0]
 		lcJSON := args[1]
 		comment := args[10]
+		lcDoc := ""
+		if len(args) == 12 {
+			lcDoc = args[11]
+		}
+
+		// A resubmitted LC must still match the purchase order it was raised for
+		poNumber, err := getLinkedPONumber(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+		if poNumber != "" {
+			po, err := getPO(stub, poNumber)
+			if err != nil {
+				return nil, err
+			}
+			if po != nil {
+				lcJSON, err = prefillLCFromPO(po, lcJSON)
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
 
-		return t.lc.ReSubmitDoc(stub, []string{UID, lcJSON, "", comment})
+		// the amended LC replaces the exposure reserved for the one it resubmits
+		row, err := getContractRow(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+		exposure, err := newExposure(UID, lcJSON, row.Columns[3].GetString_(), row.Columns[5].GetString_(), row.Columns[6].GetString_())
+		if err != nil {
+			return nil, err
+		}
+		err = reserveExposure(stub, exposure)
+		if err != nil {
+			return nil, err
+		}
+
+		lcPDF, err := storeDocument(stub, UID, "LC", lcDoc)
+		if err != nil {
+			return nil, err
+		}
+		_, err = t.lc.ReSubmitDoc(stub, []string{UID, lcJSON, lcPDF, comment})
+		if err != nil {
+			return nil, err
+		}
+		summary, err := getContractSummary(stub, UID)
+		if err != nil {
+			return nil, err
+		}
+		submitter := ""
+		if summary != nil {
+			submitter = summary.ImporterBankName
+		}
+		err = recordFingerprints(stub, UID, "LC", lcJSON, lcDoc, submitter, "ImporterBank")
+		if err != nil {
+			return nil, err
+		}
+		err = t.screenLC(stub, UID, lcJSON)
+		if err != nil {
+			return nil, err
+		}
+		return nil, t.contractChanged(stub, UID, "RESUBMITTED_BY_IB", "", "", "")
 
 	} else if function == "submitED" {
 		/*if accessControlFlag == true {
@@ -1529,6 +1711,10 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 		if err != nil {
 			return nil, err
 		}
+		err = requireDecrypted(contractID, lcJSON)
+		if err != nil {
+			return nil, err
+		}
 
 		//Validate that the BL is correct
 		if BLJSON != string([]byte(`{}`)) {
@@ -1564,6 +1750,25 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 				return nil, errors.New("Documents are not consistent with each other")
 			}
 		}
+		err = t.checkHSCodes(stub, contractID, string(lcJSON), invoiceJSON, packingListJSON)
+		if err != nil {
+			return nil, err
+		}
+
+		// Only the hash and location of the PDFs go on the ledger. They are stored once the documents have
+		// passed their checks, so a rejected presentation leaves no blobs behind.
+		BLPDF, err = storeDocument(stub, contractID, "BL", BLPDF)
+		if err != nil {
+			return nil, err
+		}
+		invoicePDF, err = storeDocument(stub, contractID, "INVOICE", invoicePDF)
+		if err != nil {
+			return nil, err
+		}
+		packingListPDF, err = storeDocument(stub, contractID, "PACKINGLIST", packingListPDF)
+		if err != nil {
+			return nil, err
+		}
 
 		//Submit the validated BL to the ledger
 		if BLJSON != "" || BLPDF != "" {
@@ -1571,6 +1776,10 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			if err != nil {
 				return nil, err
 			}
+			err = recordFingerprints(stub, contractID, "BL", BLJSON, args[1], exporterBankName, "ExporterBank")
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		//Submit the validated invoice to the ledger
@@ -1579,6 +1788,10 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			if err != nil {
 				return nil, err
 			}
+			err = recordFingerprints(stub, contractID, "INVOICE", invoiceJSON, args[2], exporterBankName, "ExporterBank")
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		//Submit the validated packing list to the ledger
@@ -1587,6 +1800,10 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			if err != nil {
 				return nil, err
 			}
+			err = recordFingerprints(stub, contractID, "PACKINGLIST", packingListJSON, args[3], exporterBankName, "ExporterBank")
+			if err != nil {
+				return nil, err
+			}
 		}
 
 		//If pay on sight is true in letter of credit, do state transition LC:ACCEPTED -> PAYMENT_RECEIVED
@@ -1603,9 +1820,21 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 				args = append(args, "Payment_due")
 			args = append(args, "PAYMENT_DUE_FROM_IB_TO_EB")
 		*/
+		err = t.screenED(stub, contractID, BLJSON, invoiceJSON, shippingCompanyname, insuranceCompanyname)
+		if err != nil {
+			return nil, err
+		}
+		err = t.flagControlledGoods(stub, contractID, invoiceJSON, packingListJSON)
+		if err != nil {
+			return nil, err
+		}
+		err = t.recordIncotermReport(stub, contractID, string(lcJSON), BLJSON, packingListJSON, insuranceCompanyname)
+		if err != nil {
+			return nil, err
+		}
 		_, err = t.lc.UpdateStatus(stub, args)
 
-		return nil, nil
+		return nil, t.contractChanged(stub, contractID, "", "SUBMITTED_BY_EB", PO_SHIPPED, "ExporterBank")
 	} else if function == "acceptED" {
 
 		if accessControlFlag == true {
@@ -1651,7 +1880,7 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			return nil, err
 		}
 
-		return nil, nil
+		return nil, t.contractChanged(stub, args[0], "", "ACCEPTED_BY_IB", PO_INVOICE_ACCEPTED, "ImporterBank")
 	} else if function == "rejectED" {
 
 		if accessControlFlag == true {
@@ -1681,7 +1910,7 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			return nil, err
 		}
 
-		return nil, nil
+		return nil, t.contractChanged(stub, args[0], "", "REJECTED_BY_IB", "", "")
 	} else if function == "acceptToPay" {
 
 		if accessControlFlag == true {
@@ -1696,15 +1925,7 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 			}
 		}
 
-		args = append(args, "Payment_due")
-		args = append(args, "PAYMENT_DUE_FROM_IB_TO_EB")
-
-		_, err := t.lc.UpdateStatus(stub, args)
-		if err != nil {
-			return nil, err
-		}
-
-		return nil, nil
+		return nil, t.makeLCPaymentDue(stub, args[0])
 	} else if function == "createPO" {
 
 		return t.po.createPO(stub, args)
@@ -1734,6 +1955,335 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 	}else if function == "acceptPayment" {
 
 		return t.po.acceptPayment(stub, args)
+	} else if function == "offerEarlyPayment" {
+
+		return t.po.offerEarlyPayment(stub, args)
+	} else if function == "decideEarlyPayment" {
+
+		return t.po.decideEarlyPayment(stub, args)
+	}else if function == "proposePOAmendment" {
+
+		return t.po.proposePOAmendment(stub, args)
+	}else if function == "approvePOAmendment" {
+
+		return t.po.approvePOAmendment(stub, args)
+	}else if function == "rejectPOAmendment" {
+
+		return t.po.rejectPOAmendment(stub, args)
+	}else if function == "reindexPOs" {
+
+		return t.po.reindexPOs(stub, args)
+	} else if function == "reindexContracts" {
+
+		return t.reindexContracts(stub, args)
+	} else if function == "submitCollection" {
+		if len(args) != 2 {
+			return nil, errors.New("Incorrect number of arguments. Expecting 2.")
+		}
+
+		// Collection documents share the document tables with LC contracts, so the IDs must not clash
+		var columns []shim.Column
+		col1 := shim.Column{Value: &shim.Column_String_{String_: "BP"}}
+		columns = append(columns, col1)
+		col2 := shim.Column{Value: &shim.Column_String_{String_: args[0]}}
+		columns = append(columns, col2)
+		row, err := stub.GetRow("BPTable", columns)
+		if err != nil {
+			return nil, err
+		}
+		if len(row.Columns) != 0 {
+			return nil, errors.New("Contract " + args[0] + " already exists.")
+		}
+
+		return t.dc.SubmitDoc(stub, args)
+	} else if function == "sendCollectionDocuments" {
+
+		return t.sendCollectionDocuments(stub, args)
+	} else if function == "updateCollectionStatus" {
+
+		return t.dc.UpdateStatus(stub, args)
+	} else if function == "issueGuarantee" {
+		if accessControlFlag == true {
+			// the issuer proves it holds the certificate it issues the guarantee with
+			if len(args) != 4 {
+				return nil, errors.New("Access denied.")
+			}
+			res, err := t.isCaller(stub, []byte(args[2]))
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.gt.SubmitDoc(stub, args)
+	} else if function == "demandGuarantee" {
+		if accessControlFlag == true && len(args) > 3 {
+			res, err := t.isCallerGuaranteeParty(stub, args[0], args[3])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.gt.Demand(stub, args)
+	} else if function == "decideGuaranteeDemand" {
+		if accessControlFlag == true && len(args) > 3 {
+			res, err := t.isCallerGuaranteeParty(stub, args[0], args[3])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.gt.DecideDemand(stub, args)
+	} else if function == "reduceGuarantee" {
+		if accessControlFlag == true && len(args) > 3 {
+			res, err := t.isCallerGuaranteeParty(stub, args[0], args[3])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.gt.Reduce(stub, args)
+	} else if function == "releaseGuarantee" {
+		if accessControlFlag == true && len(args) > 1 {
+			res, err := t.isCallerGuaranteeParty(stub, args[0], args[1])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.gt.Release(stub, args)
+	} else if function == "transferLC" {
+
+		return t.transferLC(stub, args)
+	} else if function == "presentTransferredDocs" {
+
+		return t.presentTransferredDocs(stub, args)
+	} else if function == "assignProceeds" {
+
+		return t.assignProceeds(stub, args)
+	} else if function == "acknowledgeAssignment" {
+
+		return t.acknowledgeAssignment(stub, args)
+	} else if function == "setLateInterest" {
+		if accessControlFlag == true {
+			res, err := t.isCallerImporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.setLateInterest(stub, args)
+	} else if function == "settleDefault" {
+		if accessControlFlag == true {
+			// a recovery may be booked by either bank
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				res, err = t.isCallerImporterBank(stub, []string{args[0]})
+				if err != nil {
+					return nil, err
+				}
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.settleDefault(stub, args)
+	} else if function == "writeOffDefault" {
+		if accessControlFlag == true {
+			// only the bank owed the payment can write it off
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.writeOffDefault(stub, args)
+	} else if function == "importPaymentConfirmation" {
+
+		return t.importPaymentConfirmation(stub, args)
+	} else if function == "authoriseReimbursement" {
+		if accessControlFlag == true {
+			res, err := t.isCallerImporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.authoriseReimbursement(stub, args)
+	} else if function == "claimReimbursement" {
+		if accessControlFlag == true {
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.claimReimbursement(stub, args)
+	} else if function == "decideReimbursementClaim" {
+		if accessControlFlag == true {
+			res, err := t.isCallerReimbursingBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.decideReimbursementClaim(stub, args)
+	} else if function == "confirmLC" {
+		if accessControlFlag == true {
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.confirmLC(stub, args)
+	} else if function == "payUnderConfirmation" {
+		if accessControlFlag == true {
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.payUnderConfirmation(stub, args)
+	} else if function == "recordCharge" {
+
+		return t.recordCharge(stub, args)
+	} else if function == "offerFinancing" {
+		if accessControlFlag == true {
+			res, err := t.isCallerExporterBank(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.offerFinancing(stub, args)
+	} else if function == "decideFinancing" {
+		if accessControlFlag == true {
+			res, err := t.isCallerExporter(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.decideFinancing(stub, args)
+	} else if function == "setCreditLimit" {
+		if accessControlFlag == true {
+			res, err := t.isCallerBank(stub, args[0])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.setCreditLimit(stub, args)
+	} else if function == "releaseExpiredExposures" {
+		if accessControlFlag == true {
+			res, err := t.isCallerBank(stub, args[0])
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.releaseExpiredExposures(stub, args)
+	} else if function == "loadSanctionsList" {
+		if accessControlFlag == true {
+			res, err := t.isCallerComplianceOfficer(stub)
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.loadSanctionsList(stub, args)
+	} else if function == "decideScreening" {
+		if accessControlFlag == true {
+			res, err := t.isCallerComplianceOfficer(stub)
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.decideScreening(stub, args)
+	} else if function == "loadHSCodes" {
+		if accessControlFlag == true {
+			res, err := t.isCallerComplianceOfficer(stub)
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.loadHSCodes(stub, args)
+	} else if function == "setControlledGoods" {
+		if accessControlFlag == true {
+			res, err := t.isCallerComplianceOfficer(stub)
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.setControlledGoods(stub, args)
 	}
 	
 	return nil, errors.New("Invalid invoke function name.")
@@ -1744,7 +2294,8 @@ func (t *TF) Invoke(stub shim.ChaincodeStubInterface, function string, args []st
 //func (t *TF) Query(stub *shim.ChaincodeStub, function string, args []string) ([]byte, error) {
 func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []string) ([]byte, error) {
 	type Status struct {
-		Status string
+		Status    string
+		Confirmed *bool `json:"CONFIRMED,omitempty"` // set for LCs only
 	}
 	status := Status{}
 
@@ -1780,7 +2331,41 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 			}
 		}
 
-		return t.lc.GetJSON(stub, args)
+		// An optional second argument "PDF" returns the reference to the LC PDF instead of the LC
+		if len(args) == 2 && args[1] == "PDF" {
+			return t.lc.GetPDF(stub, []string{args[0]})
+		}
+		lcJSON, err := t.lc.GetJSON(stub, []string{args[0]})
+		if err != nil {
+			return nil, err
+		}
+		return withConfirmedFlag(stub, args[0], lcJSON)
+	} else if function == "verifyDocumentHash" {
+
+		if accessControlFlag == true {
+			res, err := t.isCallerParticipant(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.verifyDocumentHash(stub, args)
+	} else if function == "verifyDocument" {
+
+		if accessControlFlag == true {
+			res, err := t.isCallerParticipant(stub, []string{args[0]})
+			if err != nil {
+				return nil, err
+			}
+			if res == false {
+				return nil, errors.New("Access denied.")
+			}
+		}
+
+		return t.verifyDocument(stub, args)
 	} else if function == "getBP" {
 
 		return t.GetBPJSON(stub, args)
@@ -1806,6 +2391,11 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 			return nil, err
 		}
 		status.Status = string(b)
+		confirmed, err := isLCConfirmed(stub, args[0])
+		if err != nil {
+			return nil, err
+		}
+		status.Confirmed = &confirmed
 
 		return json.Marshal(status)
 	} else if function == "validateLC" {
@@ -1839,13 +2429,34 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 		if err != nil {
 			return nil, err
 		}
+		err = requireDecrypted(contractID, lcJSON)
+		if err != nil {
+			return nil, err
+		}
 
 		if docType == "BL" {
-			return t.bl.ValidateDoc(stub, []string{docJSON, string(lcJSON)})
+			res, err := t.bl.ValidateDoc(stub, []string{docJSON, string(lcJSON)})
+			if err != nil {
+				return nil, err
+			}
+			// the BL is also checked against the Incoterms rule of the contract
+			report, err := t.incotermReport(stub, contractID, string(lcJSON), docJSON, "", "", false)
+			if err != nil {
+				return nil, err
+			}
+			return withIncotermFindings(res, report), nil
 		} else if docType == "INVOICE" {
 			return t.invoice.ValidateDoc(stub, []string{docJSON, string(lcJSON)})
 		} else if docType == "PACKINGLIST" {
-			return t.pl.ValidateDoc(stub, []string{docJSON, string(lcJSON)})
+			res, err := t.pl.ValidateDoc(stub, []string{docJSON, string(lcJSON)})
+			if err != nil {
+				return nil, err
+			}
+			report, err := t.incotermReport(stub, contractID, string(lcJSON), "", docJSON, "", false)
+			if err != nil {
+				return nil, err
+			}
+			return withIncotermFindings(res, report), nil
 		}
 
 		return nil, nil
@@ -1932,6 +2543,87 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 	} else if function == "listEDsByStatus" {
 
 		return t.listEDsByStatus(stub, args)
+	} else if function == "searchContracts" {
+
+		return t.searchContracts(stub, args)
+	} else if function == "getCollection" {
+
+		return t.dc.GetJSON(stub, args)
+	} else if function == "getCollectionStatus" {
+
+		b, err := t.dc.GetStatus(stub, args)
+		if err != nil {
+			return nil, err
+		}
+		status.Status = string(b)
+
+		return json.Marshal(status)
+	} else if function == "getIncotermReport" {
+
+		return t.getIncotermReport(stub, args)
+	} else if function == "getHSCode" {
+
+		return t.getHSCode(stub, args)
+	} else if function == "getControlledGoods" {
+
+		return t.getControlledGoods(stub, args)
+	} else if function == "getScreening" {
+
+		return t.getScreening(stub, args)
+	} else if function == "getSanctionsList" {
+
+		return t.getSanctionsList(stub, args)
+	} else if function == "getSettlement" {
+
+		return t.getSettlement(stub, args)
+	} else if function == "getExposureReport" {
+
+		return t.getExposureReport(stub, args)
+	} else if function == "getFinancing" {
+
+		return t.getFinancing(stub, args)
+	} else if function == "getFinancingExposure" {
+
+		return t.getFinancingExposure(stub, args)
+	} else if function == "getCharges" {
+
+		return t.getCharges(stub, args)
+	} else if function == "getConfirmation" {
+
+		return t.getConfirmation(stub, args)
+	} else if function == "getReimbursement" {
+
+		return t.getReimbursement(stub, args)
+	} else if function == "getPaymentInstruction" {
+
+		return t.getPaymentInstruction(stub, args)
+	} else if function == "getAmountDue" {
+
+		return t.getAmountDue(stub, args)
+	} else if function == "getDefault" {
+
+		return t.getDefault(stub, args)
+	} else if function == "getOutstandingBalances" {
+
+		return t.getOutstandingBalances(stub, args)
+	} else if function == "getAssignments" {
+
+		return t.getAssignments(stub, args)
+	} else if function == "getLCTransfers" {
+
+		return t.getLCTransfers(stub, args)
+	} else if function == "getGuarantee" {
+
+		return t.gt.GetJSON(stub, args)
+	} else if function == "getGuaranteeStatus" {
+
+		b, err := t.gt.GetStatus(stub, args)
+		if err != nil {
+			return nil, err
+		}
+		status.Status = string(b)
+
+		return json.Marshal(status)
 	} else if function == "getContractParticipants" {
 		if accessControlFlag == true {
 			res, err := t.isCallerParticipant(stub, []string{args[0]})
@@ -1962,6 +2654,10 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 		//
 
 	} else if function == "getPoDetails" {
+		// An optional second argument selects a historical version of the PO
+		if len(args) > 1 {
+			return t.po.getPOVersion(stub, args[0], args[1])
+		}
 		return t.po.getPoDetails(stub, args[0])
 	} else if function == "getAllPo" {
 		return t.po.getAllPo(stub, args)
@@ -1969,6 +2665,10 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 		return t.po.getAllPoForExporter(stub, args)
 	} else if function == "getAllPoForExporterBank" {
 		return t.po.getAllPoForExporterBank(stub, args)
+	} else if function == "getAllPoForImporter" {
+		return t.po.getAllPoForImporter(stub, args)
+	} else if function == "getAllPoByStatus" {
+		return t.po.getAllPoByStatus(stub, args)
 	}else if function == "getAllBOLForShippingCompany" {
 		return t.po.getAllBOLShippingCompany(stub, args)
 	}else if function == "getAllDocsPO" {
@@ -1977,6 +2677,10 @@ func (t *TF) Query(stub shim.ChaincodeStubInterface, function string, args []str
 		return t.po.getInvoice(stub, args[0])
 	}else if function == "getLC" {
 		return t.po.getLC(stub, args[0])
+	}else if function == "getPOTransitions" {
+		return t.po.getPOTransitions(stub, args)
+	}else if function == "getPOAmendments" {
+		return t.po.getPOAmendments(stub, args)
 	}
 
 	return nil, errors.New("Invalid query function name.")